@@ -0,0 +1,153 @@
+package minicomponents
+
+import (
+	"sort"
+	"strings"
+)
+
+// assetState records which components a render has used, and which of
+// their styles and scripts it has printed.
+type assetState struct {
+	used   map[string]bool
+	seeded bool
+	// printedStyles and printedScripts are keyed by component, scriptTexts
+	// by script element.
+	printedStyles  map[string]bool
+	printedScripts map[string]bool
+	scriptTexts    map[string]bool
+}
+
+func newAssetState() *assetState {
+	return &assetState{
+		printedStyles:  make(map[string]bool),
+		printedScripts: make(map[string]bool),
+		scriptTexts:    make(map[string]bool),
+	}
+}
+
+func (s *assetState) use(comp string) {
+	if s.used == nil {
+		s.used = make(map[string]bool)
+	}
+	s.used[comp] = true
+}
+
+// unprinted returns the used components that have an asset and are not in
+// printed yet, marking them as printed. The first call also counts the
+// components that page includes statically, so that the assets can be
+// printed before the components render; guarded ones are included too,
+// since whether they render is only known later.
+func (s *assetState) unprinted(cs *compiledSet, page string, extra []string, printed map[string]bool, has func(string) bool) []string {
+	if !s.seeded {
+		s.seeded = true
+		for _, comp := range cs.staticUses(page) {
+			s.use(comp)
+		}
+	}
+	for _, comp := range extra {
+		s.use(comp)
+	}
+	var names []string
+	for comp := range s.used {
+		if !printed[comp] && has(comp) {
+			names = append(names, comp)
+			printed[comp] = true
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// staticUses returns the components that a template includes directly or
+// through other components.
+func (cs *compiledSet) staticUses(name string) []string {
+	seen := map[string]bool{name: true}
+	queue := []string{name}
+	var result []string
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, use := range cs.deps[cur] {
+			if !seen[use.Name] {
+				seen[use.Name] = true
+				result = append(result, use.Name)
+				queue = append(queue, use.Name)
+			}
+		}
+	}
+	return result
+}
+
+// element is an HTML element cut out of a template by cutElements.
+type element struct {
+	// attrs are the attributes of the start tag as written, including the
+	// leading space.
+	attrs   string
+	content string
+}
+
+func (el element) hasAttr(name string) bool {
+	for _, field := range strings.Fields(strings.ToLower(strings.TrimSuffix(el.attrs, "/"))) {
+		if field == name || strings.HasPrefix(field, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+func (el element) String(tag string) string {
+	return "<" + tag + el.attrs + ">" + el.content + "</" + tag + ">"
+}
+
+// cutElements removes the <tag> elements that cut accepts from a template,
+// keeping line numbers intact, and returns them.
+func cutElements(code, tag string, cut func(element) bool) (string, []element) {
+	view := strings.ToLower(withoutRaw(code))
+	opening, closing := "<"+tag, "</"+tag+">"
+	if !strings.Contains(view, opening) {
+		return code, nil
+	}
+	var out strings.Builder
+	var elements []element
+	last := 0
+	for off := 0; ; {
+		start := indexStartTag(view, off, opening)
+		if start < 0 {
+			break
+		}
+		tagEnd := strings.IndexByte(view[start:], '>')
+		end := strings.Index(view[start:], closing)
+		if tagEnd < 0 || end < tagEnd {
+			break
+		}
+		tagEnd += start + 1
+		end += start
+		el := element{attrs: code[start+len(opening) : tagEnd-1], content: code[tagEnd:end]}
+		off = end + len(closing)
+		if !cut(el) {
+			continue
+		}
+		elements = append(elements, el)
+		out.WriteString(code[last:start])
+		out.WriteString(strings.Repeat("\n", strings.Count(code[start:end], "\n")))
+		last = off
+	}
+	out.WriteString(code[last:])
+	return out.String(), elements
+}
+
+// indexStartTag finds the start tag of an element in lowercase markup,
+// where opening is < and the tag name.
+func indexStartTag(view string, off int, opening string) int {
+	for {
+		i := strings.Index(view[off:], opening)
+		if i < 0 {
+			return -1
+		}
+		i += off + len(opening)
+		if i < len(view) && (isSpace(view[i]) || view[i] == '>' || view[i] == '/') {
+			return i - len(opening)
+		}
+		off = i
+	}
+}
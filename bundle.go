@@ -0,0 +1,228 @@
+package minicomponents
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cacheVersion changes whenever the format of cached and bundled templates
+// does. Changes to the generated code are covered by rewriterHash.
+const cacheVersion = 6
+
+// rewriterSources are the files that determine the code generated for a
+// template, so that any change to them invalidates cached and bundled
+// templates.
+//
+//go:embed assets.go bundle.go components.go frontmatter.go private.go scanner.go scripts.go styles.go
+var rewriterSources embed.FS
+
+var rewriterHash = func() string {
+	h := sha256.New()
+	files, err := fs.ReadDir(rewriterSources, ".")
+	if err != nil {
+		panic(err)
+	}
+	for _, f := range files {
+		data, err := rewriterSources.ReadFile(f.Name())
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", f.Name(), len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}()
+
+// cacheEntry is a rewritten template as stored in the cache dir and in
+// bundles.
+type cacheEntry struct {
+	Key     string              `json:"key"`
+	Code    string              `json:"code"`
+	Uses    []componentUse      `json:"uses,omitempty"`
+	Bodies  map[string]bodyInfo `json:"bodies,omitempty"`
+	Private []string            `json:"private,omitempty"`
+	Defines []string            `json:"defines,omitempty"`
+	Styles  string              `json:"styles,omitempty"`
+	Scripts []string            `json:"scripts,omitempty"`
+}
+
+type bundle struct {
+	Version   int                    `json:"version"`
+	Templates map[string]*cacheEntry `json:"templates"`
+}
+
+// SetCacheDir makes Compile store rewritten templates in dir and reuse them
+// across restarts while their source and the component defs are unchanged.
+func (r *Registry) SetCacheDir(dir string) *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cacheDir = dir
+	return r
+}
+
+// UseBundle makes Compile take rewritten templates from a bundle produced by
+// WriteBundle, typically embedded with a file generated by GenerateBundle.
+// Templates that have changed since the bundle was written are rewritten as
+// usual.
+func (r *Registry) UseBundle(data []byte) *Registry {
+	b, err := parseBundle(data)
+	if err != nil {
+		panic(fmt.Errorf("UseBundle: %w", err))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bundle = b.Templates
+	return r
+}
+
+func parseBundle(data []byte) (*bundle, error) {
+	var b bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %w", err)
+	}
+	if b.Version != cacheVersion {
+		b.Templates = nil
+	}
+	return &b, nil
+}
+
+// WriteBundle compiles the registry and writes all rewritten templates as a
+// bundle for UseBundle.
+func (r *Registry) WriteBundle(w io.Writer) error {
+	r.mu.Lock()
+	b, err := r.makeBundle()
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(b, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// CheckBundle returns an error if the bundle does not match the current
+// templates, for use in a test that keeps a checked in bundle up to date.
+func (r *Registry) CheckBundle(data []byte) error {
+	old, err := parseBundle(data)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	cur, err := r.makeBundle()
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for _, name := range sortedKeys(cur.Templates) {
+		if e := old.Templates[name]; e == nil || e.Key != cur.Templates[name].Key {
+			stale = append(stale, name)
+		}
+	}
+	for _, name := range sortedKeys(old.Templates) {
+		if cur.Templates[name] == nil {
+			stale = append(stale, name+" (removed)")
+		}
+	}
+	if len(stale) > 0 {
+		return fmt.Errorf("bundle is out of date, regenerate it: %s", strings.Join(stale, ", "))
+	}
+	return nil
+}
+
+func (r *Registry) makeBundle() (*bundle, error) {
+	if err := r.compile(); err != nil {
+		return nil, err
+	}
+	b := &bundle{Version: cacheVersion, Templates: make(map[string]*cacheEntry, len(r.rewritten))}
+	for name, rt := range r.rewritten {
+		b.Templates[name] = rt.entry()
+	}
+	return b, nil
+}
+
+// GenerateBundle writes a Go file that embeds the bundle file at
+// bundlePath, relative to the generated file, and loads it into the
+// registry on init.
+func GenerateBundle(w io.Writer, opt GenerateOptions, bundlePath string) error {
+	if opt.Package == "" || opt.Registry == "" {
+		return fmt.Errorf("GenerateOptions.Package and Registry are required")
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by minicomponents. DO NOT EDIT.\n\npackage %s\n\nimport _ \"embed\"\n\n", opt.Package)
+	fmt.Fprintf(&out, "//go:embed %s\nvar minicomponentsBundle []byte\n\n", filepath.ToSlash(bundlePath))
+	fmt.Fprintf(&out, "func init() {\n\t%s.UseBundle(minicomponentsBundle)\n}\n", opt.Registry)
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return fmt.Errorf("formatting generated code: %w\n%s", err, out.Bytes())
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// defsHash identifies the component defs that rewritten code depends on.
+func defsHash(defs map[string]*ComponentDef) string {
+	data, err := json.Marshal(defs)
+	if err != nil {
+		panic(err)
+	}
+	return hashString(string(data))
+}
+
+func cacheKey(defsHash, name, file, source string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%s\x00%s\x00", cacheVersion, rewriterHash, defsHash, name, file)
+	io.WriteString(h, source)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cached returns a rewritten template from the bundle or the cache dir.
+func (r *Registry) cached(key, name string) *cacheEntry {
+	if e := r.bundle[name]; e != nil && e.Key == key {
+		return e
+	}
+	if r.cacheDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(r.cacheDir, key+".json"))
+	if err != nil {
+		return nil
+	}
+	var e cacheEntry
+	if json.Unmarshal(data, &e) != nil || e.Key != key {
+		return nil
+	}
+	return &e
+}
+
+// storeCached saves a rewritten template in the cache dir. The cache is an
+// optimization, so failures are ignored.
+func (r *Registry) storeCached(e *cacheEntry) {
+	if r.cacheDir == "" {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if os.MkdirAll(r.cacheDir, 0o755) != nil {
+		return
+	}
+	tmp := filepath.Join(r.cacheDir, e.Key+".tmp")
+	if os.WriteFile(tmp, data, 0o644) == nil {
+		os.Rename(tmp, filepath.Join(r.cacheDir, e.Key+".json"))
+	}
+}
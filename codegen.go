@@ -0,0 +1,208 @@
+package minicomponents
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const importPath = "github.com/andreyvit/minicomponents"
+
+type GenerateOptions struct {
+	// Package is the name of the package of the generated file.
+	Package string
+	// PkgPath is the import path of that package, used to refer to props
+	// types declared in it without an import.
+	PkgPath string
+	// Registry is a Go expression evaluating to the *Registry to render with.
+	Registry string
+}
+
+// GenerateGo writes Go source with one typed Render func per component, for
+// use from a go:generate program.
+func (r *Registry) GenerateGo(w io.Writer, opt GenerateOptions) error {
+	r.mu.Lock()
+	defs, err := r.components()
+	propsTypes := make(map[string]reflect.Type)
+	for name := range defs {
+		if t := r.propsType(name); t != nil {
+			propsTypes[name] = t
+		}
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if opt.Package == "" || opt.Registry == "" {
+		return fmt.Errorf("GenerateOptions.Package and Registry are required")
+	}
+
+	g := &generator{
+		pkgPath: opt.PkgPath,
+		imports: map[string]string{"io": "io", importPath: "minicomponents"},
+	}
+	var body bytes.Buffer
+	for _, name := range sortedKeys(defs) {
+		g.component(&body, name, defs[name], propsTypes[name], opt.Registry)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by minicomponents. DO NOT EDIT.\n\npackage %s\n\nimport (\n", opt.Package)
+	for _, p := range sortedKeys(g.imports) {
+		if alias := g.imports[p]; alias != path.Base(p) {
+			fmt.Fprintf(&out, "\t%s %q\n", alias, p)
+		} else {
+			fmt.Fprintf(&out, "\t%q\n", p)
+		}
+	}
+	out.WriteString(")\n")
+	out.Write(body.Bytes())
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return fmt.Errorf("formatting generated code: %w\n%s", err, out.Bytes())
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// propsType returns the props struct type of the Go func of a component, if
+// any. The caller holds r.mu.
+func (r *Registry) propsType(name string) reflect.Type {
+	if g := r.render[name]; g != nil {
+		return g.propsType
+	}
+	if g := r.prepare[name]; g != nil {
+		return g.propsType
+	}
+	return nil
+}
+
+type generator struct {
+	pkgPath string
+	imports map[string]string
+}
+
+func (g *generator) component(out *bytes.Buffer, name string, def *ComponentDef, propsType reflect.Type, registry string) {
+	ident := camelCase(strings.TrimPrefix(name, "c-"))
+
+	var propsExpr, propsParam string
+	propsAssign := ":="
+	acceptsBody := def.Props == nil || def.HasSlots || findProp(def.Props, "body") >= 0
+	switch {
+	case propsType != nil && structType(propsType).Name() != "":
+		propsParam = "p " + g.typeName(propsType)
+		propsExpr = "minicomponents.StructArgs(p)"
+	case def.Props != nil:
+		// props declared by an anonymous struct keep their Go types, the
+		// ones only declared in front matter can be anything
+		fieldTypes := make(map[string]reflect.Type)
+		if propsType != nil {
+			st := structType(propsType)
+			fields, _ := propFields(st)
+			for _, f := range fields {
+				fieldTypes[f.Name] = st.FieldByIndex(f.index).Type
+			}
+		}
+		typeName := ident + "Props"
+		fmt.Fprintf(out, "\ntype %s struct {\n", typeName)
+		for _, prop := range def.Props {
+			if prop.Name == "body" {
+				continue
+			}
+			tag := prop.Name
+			if prop.Required {
+				tag += ",required"
+			}
+			typ := "any"
+			if t := fieldTypes[prop.Name]; t != nil {
+				typ = g.typeName(t)
+			}
+			fmt.Fprintf(out, "\t%s %s `mc:%s`\n", camelCase(prop.Name), typ, strconv.Quote(tag))
+		}
+		out.WriteString("}\n")
+		propsParam = "p " + typeName
+		propsExpr = "minicomponents.StructArgs(p)"
+	default:
+		propsParam = "args map[string]any"
+		propsExpr = "minicomponents.Args(args)"
+		propsAssign = "="
+	}
+
+	fmt.Fprintf(out, "\nfunc Render%s(w io.Writer, %s", ident, propsParam)
+	if acceptsBody {
+		out.WriteString(", body func(io.Writer) error")
+	}
+	out.WriteString(") error {\n")
+	fmt.Fprintf(out, "\targs %s %s\n", propsAssign, propsExpr)
+	if acceptsBody {
+		out.WriteString("\tif body != nil {\n\t\targs[\"body\"] = body\n\t}\n")
+	}
+	fmt.Fprintf(out, "\treturn %s.RenderComponent(w, %q, nil, args)\n}\n", registry, name)
+}
+
+// typeName returns the Go source for t, importing its package if needed.
+// Types that can't be spelled outside their package become any.
+func (g *generator) typeName(t reflect.Type) string {
+	if t.Name() == "" {
+		switch t.Kind() {
+		case reflect.Pointer:
+			return "*" + g.typeName(t.Elem())
+		case reflect.Slice:
+			return "[]" + g.typeName(t.Elem())
+		case reflect.Array:
+			return fmt.Sprintf("[%d]%s", t.Len(), g.typeName(t.Elem()))
+		case reflect.Map:
+			return "map[" + g.typeName(t.Key()) + "]" + g.typeName(t.Elem())
+		}
+		return "any"
+	}
+	if t.PkgPath() == "" || t.PkgPath() == g.pkgPath {
+		return t.Name()
+	}
+	if !token.IsExported(t.Name()) {
+		return "any"
+	}
+	alias, ok := g.imports[t.PkgPath()]
+	if !ok {
+		alias = path.Base(t.PkgPath())
+		for base, i := alias, 2; g.hasAlias(alias); i++ {
+			alias = base + strconv.Itoa(i)
+		}
+		g.imports[t.PkgPath()] = alias
+	}
+	return alias + "." + t.Name()
+}
+
+func (g *generator) hasAlias(alias string) bool {
+	for _, a := range g.imports {
+		if a == alias {
+			return true
+		}
+	}
+	return false
+}
+
+func camelCase(s string) string {
+	var buf strings.Builder
+	upper := true
+	for _, r := range s {
+		if r == '-' || r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
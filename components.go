@@ -1,25 +1,23 @@
 package minicomponents
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"regexp"
 	"strconv"
 	"strings"
+	"text/template/parse"
 	"unicode"
 )
 
 var (
-	startRe         = regexp.MustCompile(`(?i)<(c-[a-z0-9-]+)`)
-	whitespace      = " \t\n"
-	endOpenRe       = regexp.MustCompile(`^/?>`)
-	endBrokenOpenRe = regexp.MustCompile(`/?>`)
-
-	attrStartRe             = regexp.MustCompile(`(?i)^([a-z0-9-]+)([=\s/>])`)
-	attrQuotedValueRe       = regexp.MustCompile(`(?i)^"([^"]*)"`)
-	attrSingleQuotedValueRe = regexp.MustCompile(`(?i)^'([^']*)'`)
-	attrNakedValueRe        = regexp.MustCompile(`(?i)^[^\s/<>"']+`)
-	attrGoValueRe           = regexp.MustCompile(`(?i)^\{\{(.+?)\}\}`)
-	brokenAttrEndRe         = regexp.MustCompile(`(?i)(\s|/?>)`)
+	whitespace = " \t\n"
+
+	slotRe = regexp.MustCompile(`(?i)<c-slot-([a-z0-9-]+)`)
+
+	bodyPrintRe = regexp.MustCompile(`\{\{(-\s+|\s*)(\$?\.Args\.body)(\s+-|\s*)\}\}`)
 )
 
 type RenderMethod int
@@ -30,14 +28,40 @@ const (
 	RenderMethodFunc
 	RenderMethodFuncThenTemplate
 	renderMethodSlot
+	renderMethodDynamic
+	renderMethodFor
+	renderMethodIf
+	renderMethodElse
+	renderMethodEach
 )
 
+// dynamicComponent is the built-in component that renders the component
+// named by its is attr, looked up at runtime.
+const dynamicComponent = "c-dynamic"
+
+// builtinComponents are handled by the rewriter itself, unless the registry
+// has components of the same names.
+var builtinComponents = map[string]*ComponentDef{
+	dynamicComponent: {RenderMethod: renderMethodDynamic, HasSlots: true},
+	"c-for":          {RenderMethod: renderMethodFor},
+	"c-if":           {RenderMethod: renderMethodIf},
+	"c-else-if":      {RenderMethod: renderMethodElse},
+	"c-else":         {RenderMethod: renderMethodElse},
+	"c-each":         {RenderMethod: renderMethodEach},
+}
+
+func (c *ComponentDef) isControlFlow() bool {
+	return c.RenderMethod == renderMethodFor || c.RenderMethod == renderMethodIf || c.RenderMethod == renderMethodElse
+}
+
 type ComponentDef struct {
 	RenderMethod RenderMethod
 	FuncName     string
 	TemplateName string
 	SlotName     string
 	HasSlots     bool
+	Props        []Prop
+	Slots        []string
 }
 
 func (c *ComponentDef) funcName(compName string) string {
@@ -62,6 +86,8 @@ type Component struct {
 	Name string
 	Body string
 	Args []Arg
+	// exprArgs are the names of the attrs given as {{...}} expressions.
+	exprArgs []string
 }
 
 type Arg struct {
@@ -92,19 +118,105 @@ func errf(orig, templ string, format string, args ...any) *ParseErr {
 }
 
 type rewriter struct {
-	comps    map[string]*ComponentDef
-	trailers strings.Builder
-	err      error
+	comps      map[string]*ComponentDef
+	trailers   strings.Builder
+	err        error
+	uses       []componentUse
+	guarded    bool
+	trackCalls bool
+	file       string
+	bodies     map[string]bodyInfo
+	defined    map[definedBody]string
+	pending    []pendingBody
+	spans      []bodySpan
+	private    []string
+	defines    []string
+	// loopVars are the variables of the <c-for> tags being rewritten.
+	loopVars []string
+	locals   map[string]*ComponentDef
+	branch   *branchState
+}
+
+// branchState tracks the <c-else-if> and <c-else> tags in the body of a
+// <c-if> or <c-for> being rewritten.
+type branchState struct {
+	tag     string
+	sawElse bool
+}
+
+type definedBody struct {
+	code string
+	info bodyInfo
+}
+
+// bodyInfo describes where a generated body template comes from, so that
+// runtime errors can refer to the source instead of the generated name.
+type bodyInfo struct {
+	Comp string
+	Pos  string
+}
+
+// componentUse records a component tag. Guarded uses are nested in an if,
+// range or with action, so they might not render.
+type componentUse struct {
+	Name    string
+	Guarded bool
 }
 
 func Rewrite(templ string, baseName string, comps map[string]*ComponentDef) (string, error) {
+	res, err := rewriteTemplate(templ, baseName, comps, rewriteOptions{})
+	return res.code, err
+}
+
+type rewriteOptions struct {
+	// trackCalls makes component invocations go through $.Call instead of
+	// $.Bind, so that the runtime can maintain a component call stack.
+	trackCalls bool
+	// file is used in the source positions passed to $.Call; defaults to
+	// the template name.
+	file string
+}
+
+type rewriteResult struct {
+	code   string
+	uses   []componentUse
+	bodies map[string]bodyInfo
+	// private lists the names of the private templates that the code
+	// defines or calls, other than bodies.
+	private []string
+	// defines lists the templates of the components defined by <c-define>.
+	defines []string
+}
+
+func rewriteTemplate(templ string, baseName string, comps map[string]*ComponentDef, opts rewriteOptions) (*rewriteResult, error) {
+	// only components have front matter; in pages, a leading --- is content
+	frontMatterLines := 0
+	if isComponentName(baseName) {
+		meta, body, lines, found := cutFrontMatter(templ)
+		if found {
+			if err := parseFrontMatter(meta, &ComponentDef{}); err != nil {
+				return &rewriteResult{}, err
+			}
+			templ, frontMatterLines = body, lines
+		}
+	}
+	templ, private := expandShorthands(templ, baseName)
 	r := rewriter{
-		comps: comps,
+		private:    private,
+		comps:      comps,
+		trackCalls: opts.trackCalls,
+		file:       opts.file,
+		bodies:     make(map[string]bodyInfo),
+		defined:    make(map[definedBody]string),
+		locals:     make(map[string]*ComponentDef),
+	}
+	if r.file == "" {
+		r.file = baseName
 	}
 	var output strings.Builder
-	r.rewrite(&output, templ, baseName)
+	r.rewrite(&output, newSourceText(templ, 1+frontMatterLines), 0, baseName)
 	output.WriteString(r.trailers.String())
-	return output.String(), r.err
+	return &rewriteResult{code: r.nameBodies(output.String()), uses: r.uses, bodies: r.bodies, private: r.private, defines: r.defines}, r.err
 }
 
 func (r *rewriter) fail(err error) {
@@ -113,25 +225,74 @@ func (r *rewriter) fail(err error) {
 	}
 }
 
-func (r *rewriter) rewrite(output *strings.Builder, templ string, baseName string) {
-	templ = strings.ReplaceAll(templ, "$@", "$.Args.")
-	templ = strings.ReplaceAll(templ, "@@__", baseName+"__")
-	var retErr error
-	orig := templ
-	nextSlotTemplateIndex := 1
+// rewrite rewrites src.text from the given offset on. Bodies are rewritten
+// in views of src, so each part of the template is scanned once however
+// deeply the tags nest.
+func (r *rewriter) rewrite(output *strings.Builder, src *sourceText, from int, baseName string) {
+	branch := r.branch
+	r.branch = nil
+	orig := src.text
+	templ := orig[from:]
+	var blocks blockTracker
 	for {
 		// log.Printf("parsing %q", templ)
-		m := startRe.FindStringSubmatchIndex(templ)
-		if m == nil {
-			output.WriteString(templ)
+		start, nameEnd := findComponentTag(templ)
+		offset := len(orig) - len(templ)
+		esc, off := src.escapes.find(src.full, offset), src.rawRegions.find(src.full, offset)
+		if special := firstFound(esc, off); special >= 0 && special < len(orig) && (start < 0 || special < offset+start) {
+			text := orig[offset:special]
+			output.WriteString(rewriteBodyPrints(src, offset, text))
+			blocks.scan(text)
+			if special == esc {
+				output.WriteString("<")
+				templ = orig[special+2:]
+			} else {
+				rest := orig[special+len(rawOffMarker):]
+				raw, after, found := strings.Cut(rest, rawOnMarker)
+				if !found {
+					r.writeError(output, "minicomponents:off", src.errf(rest, "missing %s", rawOnMarker))
+					templ = rest
+					continue
+				}
+				output.WriteString(raw)
+				blocks.scan(raw)
+				templ = after
+			}
+			continue
+		}
+		if start < 0 {
+			output.WriteString(rewriteBodyPrints(src, len(orig)-len(templ), templ))
 			break
 		}
-		output.WriteString(templ[:m[0]])
-		name := templ[m[2]:m[3]]
+		output.WriteString(rewriteBodyPrints(src, len(orig)-len(templ), templ[:start]))
+		blocks.scan(templ[:start])
+		guarded := r.guarded || blocks.guarded()
+		name := templ[start+1 : nameEnd]
+		if strings.EqualFold(name, "c-raw") && strings.HasPrefix(templ[nameEnd:], ">") {
+			closing := "</" + name + ">"
+			raw, after, found := strings.Cut(templ[nameEnd+1:], closing)
+			if !found {
+				r.writeError(output, name, src.errf(templ[nameEnd+1:], "missing %s", closing))
+				templ = templ[nameEnd+1:]
+				continue
+			}
+			output.WriteString(raw)
+			blocks.scan(raw)
+			templ = after
+			continue
+		}
+		if strings.EqualFold(name, "c-define") {
+			templ = r.rewriteDefine(output, src, templ[nameEnd:], name, baseName)
+			continue
+		}
+		tagStart := len(orig) - len(templ) + start
+		tagLine := src.lineAt(tagStart)
+		inText := src.isTextAt(tagStart)
+		pos := r.file + ":" + strconv.Itoa(tagLine)
 		// log.Printf("open %q", name)
 
 		var precededBySpace bool
-		templ, precededBySpace = skipSpace(templ[m[1]:])
+		templ, precededBySpace = skipSpace(templ[nameEnd:])
 
 		c := &Component{
 			Name: name,
@@ -144,112 +305,147 @@ func (r *rewriter) rewrite(output *strings.Builder, templ string, baseName strin
 				RenderMethod: renderMethodSlot,
 				SlotName:     slot,
 			}
+		} else if local := r.locals[c.Name]; local != nil {
+			comp = local
+		} else if local, ok := strings.CutPrefix(c.Name, "c-"+privatePrefix); ok {
+			comp = &ComponentDef{
+				RenderMethod: RenderMethodTemplate,
+				TemplateName: baseName + "__" + local,
+			}
+			r.private = append(r.private, comp.TemplateName)
+		} else if builtin := builtinComponents[c.Name]; builtin != nil && r.comps[c.Name] == nil {
+			comp = builtin
 		} else {
 			comp = r.comps[c.Name]
+			r.uses = append(r.uses, componentUse{c.Name, guarded})
 		}
 		if tagErr == nil && comp == nil {
-			tagErr = errf(orig, templ, fmt.Sprintf("unknown component <%s>", c.Name))
+			tagErr = src.errf(templ, "unknown component <%s>", c.Name)
 		}
 
 		isClosed := false
-		endRe := endOpenRe
+		broken := false
 		for {
 			// log.Printf("parsing attrs at %q, precededBySpace=%v", templ, precededBySpace)
 
-			if m := endRe.FindStringIndex(templ); m != nil {
-				isClosed = (templ[m[0]:m[1]] == "/>")
-				templ = templ[m[1]:]
+			endStart, endEnd := 0, scanTagEnd(templ)
+			if broken {
+				endStart, endEnd = findTagEnd(templ)
+			}
+			if endEnd >= 0 {
+				isClosed = (templ[endStart:endEnd] == "/>")
+				templ = templ[endEnd:]
 				break
 			}
 
-			if m = attrStartRe.FindStringSubmatchIndex(templ); precededBySpace && m != nil {
-				attrName := templ[m[2]:m[3]]
-				attrSep := templ[m[4]:m[5]]
+			if n := scanAttrName(templ); precededBySpace && n >= 0 {
+				attrName := templ[:n]
+				attrSep := templ[n]
 				var value, rawValue string
 				var valueOK bool = true
 				// log.Printf("attrName=%q attrSep=%q", attrName, attrSep)
-				if attrSep == "=" {
-					templ = trimSpace(templ[m[1]:])
-					if m := attrQuotedValueRe.FindStringSubmatchIndex(templ); m != nil {
-						rawValue = templ[m[2]:m[3]]
+				if attrSep == '=' {
+					templ = trimSpace(templ[n+1:])
+					if raw, n := scanQuoted(templ, '"'); n >= 0 {
+						rawValue = raw
 						value, valueOK = rewriteInterpolatedStringAsExpr(rawValue)
-						templ = templ[m[1]:]
-					} else if m := attrSingleQuotedValueRe.FindStringSubmatchIndex(templ); m != nil {
-						rawValue = templ[m[2]:m[3]]
+						templ = templ[n:]
+					} else if raw, n := scanQuoted(templ, '\''); n >= 0 {
+						rawValue = raw
 						value, valueOK = rewriteInterpolatedStringAsExpr(rawValue)
-						templ = templ[m[1]:]
-					} else if m := attrGoValueRe.FindStringSubmatchIndex(templ); m != nil {
-						rawValue = templ[m[2]:m[3]]
+						templ = templ[n:]
+					} else if raw, n := scanGoValue(templ); n >= 0 {
+						rawValue = raw
 						value = "(" + rawValue + ")"
-						templ = templ[m[1]:]
-					} else if m := attrNakedValueRe.FindStringSubmatchIndex(templ); m != nil {
-						rawValue = templ[m[0]:m[1]]
+						templ = templ[n:]
+						c.exprArgs = append(c.exprArgs, attrName)
+					} else if n := scanNakedValue(templ); n >= 0 {
+						rawValue = templ[:n]
 						value = strconv.Quote(rawValue)
-						templ = templ[m[1]:]
-					} else if m := brokenAttrEndRe.FindStringIndex(templ); m != nil {
+						templ = templ[n:]
+					} else if i := findAttrEnd(templ); i >= 0 {
 						if tagErr == nil {
-							tagErr = errf(orig, templ, "missing value for attr %s", attrName)
+							tagErr = src.errf(templ, "missing value for attr %s", attrName)
 						}
-						templ = templ[m[0]:]
+						templ = templ[i:]
 						value = "nil"
 					} else {
 						if tagErr == nil {
-							tagErr = errf(orig, templ, "invalid syntax of attr %s", attrName)
+							tagErr = src.errf(templ, "invalid syntax of attr %s", attrName)
 						}
-						endRe = endBrokenOpenRe
+						broken = true
 						break
 					}
 					if !valueOK {
 						// TODO: we could build a template and then eval it
 						if tagErr == nil {
-							tagErr = errf(orig, templ, "cannot represent attr %q value %s as a single call", attrName, rawValue)
+							tagErr = src.errf(templ, "cannot represent attr %q value %s as a single call", attrName, rawValue)
 						}
 					}
 				} else {
-					templ = templ[m[4]:]
+					templ = templ[n:]
 					value = "true"
 				}
 				// log.Printf("attr %q = %v", attrName, value)
 				templ, precededBySpace = skipSpace(templ)
 				c.Args = append(c.Args, Arg{attrName, value})
 			} else {
-				if endRe == endBrokenOpenRe {
+				if broken {
 					if tagErr == nil {
-						tagErr = errf(orig, templ, "missing end of tag")
+						tagErr = src.errf(templ, "missing end of tag")
 					}
 					break
 				} else {
 					if tagErr == nil {
-						tagErr = errf(orig, templ, "invalid syntax or missing end of tag")
+						tagErr = src.errf(templ, "invalid syntax or missing end of tag")
 					}
-					endRe = endBrokenOpenRe
+					broken = true
 				}
 			}
 		}
 
-		if !isClosed {
+		bodyStart := len(orig) - len(templ)
+		bodySrc := src
+		if !isClosed && comp != nil && comp.RenderMethod != renderMethodElse {
 			closing := "</" + name + ">"
 
-			if before, after, found := strings.Cut(templ, closing); found {
-				c.Body = before
-				templ = after
+			if end, after := src.closingTag(bodyStart, name); end >= 0 {
+				c.Body = orig[bodyStart:end]
+				bodySrc = src.upTo(end)
+				templ = orig[after:]
 			} else {
 				if tagErr == nil {
-					tagErr = errf(orig, templ, "missing %s", closing)
+					tagErr = src.errf(templ, "missing %s", closing)
 				}
 			}
 		}
 
+		if tagErr == nil && comp.Props != nil {
+			tagErr = checkProps(src, templ, c, comp.Props)
+		}
+		if tagErr == nil && comp.RenderMethod == renderMethodDynamic && findArg(c.Args, "is") < 0 {
+			tagErr = src.errf(templ, "missing is attr")
+		}
+		var flowAction, eachCode string
+		var flowVars []string
+		if tagErr == nil && comp.isControlFlow() {
+			flowAction, flowVars, tagErr = controlFlowAction(src, templ, c, branch)
+		}
+		if tagErr == nil && comp.RenderMethod == renderMethodEach {
+			eachCode, tagErr = eachSource(src, templ, c)
+		}
+
 		hasSlots := (comp != nil && comp.HasSlots)
 		var usesSlotTemplate bool
 		var bodyExpr string
-		if hasSlots {
+		if comp != nil && (comp.isControlFlow() || comp.RenderMethod == renderMethodEach) {
+			// the body is rewritten inline below
+		} else if hasSlots {
 			usesSlotTemplate = true
 		} else if c.Body != "" {
 			var ok bool
-			bodyExpr, ok = rewriteInterpolatedStringAsExpr(strings.TrimSpace(c.Body))
+			bodyExpr, ok = rewriteBodyAsExpr(strings.TrimSpace(c.Body))
 			// log.Printf("<%s> ok=%v body: %q bodyExpr: %q", c.Name, ok, c.Body, bodyExpr)
-			ok = false // quick fix for escaping problems
 			if !ok {
 				usesSlotTemplate = true
 			}
@@ -258,37 +454,68 @@ func (r *rewriter) rewrite(output *strings.Builder, templ string, baseName strin
 		var slotTemplateName string
 		var slotArgs []Arg
 		if usesSlotTemplate {
-			slotTemplateName = baseName + "___" + c.Name + "__body__" + strconv.Itoa(nextSlotTemplateIndex)
-			nextSlotTemplateIndex++
-
 			var subout strings.Builder
-			fmt.Fprintf(&subout, "{{define %q}}{{with .Data}}", slotTemplateName)
-			r.rewrite(&subout, c.Body, slotTemplateName)
-			subout.WriteString("{{end}}{{end}}")
-			r.trailers.WriteString(subout.String())
+			saved := r.guarded
+			r.guarded = guarded
+			mark := len(r.spans)
+			r.rewrite(&subout, bodySrc, bodyStart, baseName)
+			r.guarded = saved
+			hash := r.bodyHash(c.Name, bodySrc, bodyStart, mark)
+			r.spans = append(r.spans[:mark], bodySpan{src.sourceState, bodyStart, len(bodySrc.text), hash})
+			if v := undefinedVariable(subout.String(), r.loopVars); v != "" {
+				if tagErr == nil {
+					tagErr = src.errf(templ, "%s of the enclosing <c-for> is not available in the body of <%s>, which renders as a separate template", v, c.Name)
+				}
+			} else {
+				slotTemplateName = r.defineBody(baseName, c, hash, subout.String(), bodyInfo{Comp: c.Name, Pos: pos})
+			}
 
 			if hasSlots {
 				arg := Arg{"bodyTemplate", strconv.Quote(slotTemplateName)}
 				c.Args = append(c.Args, arg)
 				slotArgs = append(slotArgs, arg)
 			} else {
-				c.Args = append(c.Args, Arg{"body", fmt.Sprintf("(eval %q ($.Bind .))", slotTemplateName)})
+				c.Args = append(c.Args, Arg{"body", fmt.Sprintf("(lazy_eval %q ($.Bind .))", slotTemplateName)})
 			}
 		} else if c.Body != "" {
 			c.Args = append(c.Args, Arg{"body", bodyExpr})
 		}
 
 		if tagErr != nil {
-			if retErr == nil {
-				retErr = fmt.Errorf("%s: %w", name, tagErr)
-			}
-			output.WriteString("{{error ")
-			output.WriteString(strconv.Quote(tagErr.Msg))
-			output.WriteString("}}")
+			r.writeError(output, name, tagErr)
 		} else {
-			if comp.RenderMethod == renderMethodSlot {
-				fmt.Fprintf(output, "{{eval $.Args.%sTemplate", comp.SlotName)
-				writeBindArgs(output, c.Args, "(or $.Args.callerData $.Data)")
+			if comp.RenderMethod == renderMethodElse {
+				output.WriteString(flowAction)
+			} else if comp.isControlFlow() {
+				output.WriteString(flowAction)
+				saved, savedVars := r.guarded, r.loopVars
+				r.guarded = true
+				r.loopVars = append(r.loopVars[:len(r.loopVars):len(r.loopVars)], flowVars...)
+				r.branch = &branchState{tag: c.Name}
+				r.rewrite(output, bodySrc, bodyStart, baseName)
+				r.guarded, r.loopVars = saved, savedVars
+				output.WriteString("{{end}}")
+			} else if comp.RenderMethod == renderMethodEach {
+				saved := r.guarded
+				r.guarded = true
+				r.rewrite(output, newSourceText(eachCode, tagLine), 0, baseName)
+				r.guarded = saved
+			} else if comp.RenderMethod == renderMethodSlot {
+				evalFunc := "eval"
+				if inText {
+					evalFunc = "write_eval"
+				}
+				fmt.Fprintf(output, "{{%s $.Args.%sTemplate", evalFunc, comp.SlotName)
+				writeBindArgs(output, c.Args, "(or $.Args.callerData $.Data)", "$.Bind")
+				output.WriteString("}}")
+			} else if comp.RenderMethod == renderMethodDynamic {
+				dynamicFunc := "dynamic"
+				if inText {
+					dynamicFunc = "write_dynamic"
+				}
+				i := findArg(c.Args, "is")
+				fmt.Fprintf(output, "{{%s $ %s %q .", dynamicFunc, c.Args[i].Value, pos)
+				writeBindExtraArgs(output, append(c.Args[:i:i], c.Args[i+1:]...))
 				output.WriteString("}}")
 			} else {
 				switch comp.RenderMethod {
@@ -301,7 +528,9 @@ func (r *rewriter) rewrite(output *strings.Builder, templ string, baseName strin
 				case RenderMethodFuncThenTemplate:
 					output.WriteString("{{template ")
 					output.WriteString(strconv.Quote(comp.templName(c.Name)))
-					output.WriteString(" ($.Bind (")
+					output.WriteString(" (")
+					output.WriteString(r.bindFunc(c.Name, pos))
+					output.WriteString(" (")
 					output.WriteString(comp.funcName(c.Name))
 				default:
 					panic(fmt.Errorf("unsupported render method %v", comp.RenderMethod))
@@ -312,7 +541,7 @@ func (r *rewriter) rewrite(output *strings.Builder, templ string, baseName strin
 				} else {
 					dataExpr = "nil"
 				}
-				writeBindArgs(output, c.Args, dataExpr)
+				writeBindArgs(output, c.Args, dataExpr, r.bindFunc(c.Name, pos))
 				switch comp.RenderMethod {
 				case RenderMethodTemplate, RenderMethodFunc:
 					output.WriteString("}}")
@@ -329,13 +558,517 @@ func (r *rewriter) rewrite(output *strings.Builder, templ string, baseName strin
 	}
 }
 
-func writeBindArgs(wr *strings.Builder, args []Arg, dataExpr string) {
+// controlFlowAction returns the action that starts a <c-for> or <c-if>,
+// or continues one for <c-else-if> and <c-else>, and the variables that a
+// <c-for> declares.
+func controlFlowAction(src *sourceText, templ string, c *Component, branch *branchState) (string, []string, *ParseErr) {
+	var allowed []string
+	switch c.Name {
+	case "c-for":
+		allowed = []string{"each", "as", "index"}
+	case "c-if", "c-else-if":
+		allowed = []string{"cond"}
+	}
+	for _, arg := range c.Args {
+		if !contains(allowed, arg.Name) {
+			return "", nil, src.errf(templ, "unknown attr %s", arg.Name)
+		}
+	}
+	attr := func(name string) string {
+		if i := findArg(c.Args, name); i >= 0 {
+			return c.Args[i].Value
+		}
+		return ""
+	}
+	// a string is always true and can't be ranged over, so cond="..." and
+	// each="..." are mistakes for {{...}}
+	expr := func(name string) (string, *ParseErr) {
+		value := attr(name)
+		if value == "" {
+			return "", src.errf(templ, "missing %s attr", name)
+		}
+		if !contains(c.exprArgs, name) {
+			return "", src.errf(templ, "%s must be a {{...}} expression, got %s", name, value)
+		}
+		return value, nil
+	}
+	variable := func(name string) (string, *ParseErr) {
+		value := attr(name)
+		if value == "" {
+			return "", nil
+		}
+		ident, err := strconv.Unquote(value)
+		if err != nil || ident == "" || !isIdent(ident) {
+			return "", src.errf(templ, "%s must be a variable name, got %s", name, value)
+		}
+		return "$" + ident, nil
+	}
+
+	switch c.Name {
+	case "c-for":
+		each, err := expr("each")
+		if err != nil {
+			return "", nil, err
+		}
+		as, err := variable("as")
+		if err != nil {
+			return "", nil, err
+		}
+		index, err := variable("index")
+		if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case index != "":
+			vars := []string{index}
+			if as == "" {
+				as = "$_"
+			} else {
+				vars = append(vars, as)
+			}
+			return fmt.Sprintf("{{range %s, %s := %s}}", index, as, each), vars, nil
+		case as != "":
+			return fmt.Sprintf("{{range %s := %s}}", as, each), []string{as}, nil
+		default:
+			return fmt.Sprintf("{{range %s}}", each), nil, nil
+		}
+	case "c-if":
+		cond, err := expr("cond")
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("{{if %s}}", cond), nil, nil
+	case "c-else-if":
+		if branch == nil || branch.tag != "c-if" || branch.sawElse {
+			return "", nil, src.errf(templ, "<c-else-if> must be directly inside <c-if>, before <c-else>")
+		}
+		cond, err := expr("cond")
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("{{else if %s}}", cond), nil, nil
+	default:
+		if branch == nil || branch.sawElse {
+			return "", nil, src.errf(templ, "<c-else> must be directly inside <c-if> or <c-for>, once")
+		}
+		branch.sawElse = true
+		return "{{else}}", nil, nil
+	}
+}
+
+// eachSource expands <c-each> into the markup it stands for, which is then
+// rewritten as usual: a range over the items that renders the component for
+// each of them, wrapped in a tag with an id derived from the key. Attrs
+// other than the ones of c-each are passed to the component.
+func eachSource(src *sourceText, templ string, c *Component) (string, *ParseErr) {
+	var items, key, comp, prefix, as string
+	tag := "div"
+	var oob string
+	var attrs strings.Builder
+	for _, arg := range c.Args {
+		switch arg.Name {
+		case "items":
+			items = arg.Value
+		case "key":
+			key = arg.Value
+		case "component", "tag", "prefix", "as":
+			name, err := strconv.Unquote(arg.Value)
+			if err != nil || name == "" || nameLen(name) != len(name) {
+				return "", src.errf(templ, "%s must be a name, got %s", arg.Name, arg.Value)
+			}
+			switch arg.Name {
+			case "component":
+				comp = name
+			case "tag":
+				tag = name
+			case "prefix":
+				prefix = name
+			case "as":
+				as = name
+			}
+		case "oob":
+			switch arg.Value {
+			case "true", `"true"`:
+				oob = ` hx-swap-oob="true"`
+			case `"false"`:
+			default:
+				if _, err := strconv.Unquote(arg.Value); err == nil {
+					return "", src.errf(templ, "oob must be true, false or {{...}}, got %s", arg.Value)
+				}
+				oob = fmt.Sprintf(`{{if %s}} hx-swap-oob="true"{{end}}`, arg.Value)
+			}
+		default:
+			fmt.Fprintf(&attrs, " %s={{%s}}", arg.Name, arg.Value)
+		}
+	}
+	if items == "" {
+		return "", src.errf(templ, "missing items attr")
+	}
+	if key == "" {
+		return "", src.errf(templ, "missing key attr")
+	}
+	if !isComponentName(comp) {
+		return "", src.errf(templ, "missing component attr")
+	}
+	if field, err := strconv.Unquote(key); err == nil {
+		for _, part := range strings.Split(field, ".") {
+			if !isIdent(part) {
+				return "", src.errf(templ, "key must be a field name or an expression, got %s", key)
+			}
+		}
+		key = "." + field
+	}
+	if prefix == "" {
+		prefix = strings.TrimPrefix(comp, "c-")
+	}
+	itemAttr := "data"
+	if as != "" {
+		itemAttr = as
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, `{{range %s}}<%s id="%s-{{%s}}"`, items, tag, prefix, key)
+	buf.WriteString(oob)
+	fmt.Fprintf(&buf, "><%s %s={{.}}%s", comp, itemAttr, attrs.String())
+	if c.Body != "" {
+		fmt.Fprintf(&buf, ">%s</%s>", c.Body, comp)
+	} else {
+		buf.WriteString(" />")
+	}
+	fmt.Fprintf(&buf, "</%s>{{end}}", tag)
+	return buf.String(), nil
+}
+
+// undefinedVariable returns the first of vars that the code of a body uses
+// without declaring it.
+func undefinedVariable(code string, vars []string) string {
+	if usedVariable(code, vars) == "" {
+		return ""
+	}
+	tree := parse.New("body")
+	tree.Mode = parse.SkipFuncCheck
+	_, err := tree.Parse(code, "", "", make(map[string]*parse.Tree))
+	if err == nil {
+		return ""
+	}
+	for _, v := range vars {
+		if strings.Contains(err.Error(), fmt.Sprintf("undefined variable %q", v)) {
+			return v
+		}
+	}
+	return ""
+}
+
+// usedVariable returns the first of vars that code mentions.
+func usedVariable(code string, vars []string) string {
+	for _, v := range vars {
+		for off := 0; ; {
+			i := strings.Index(code[off:], v)
+			if i < 0 {
+				break
+			}
+			off += i + len(v)
+			if off == len(code) || !(code[off] == '_' || isNameChar(code[off]) && code[off] != '-') {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+func isIdent(s string) bool {
+	for i, r := range s {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func (r *rewriter) writeError(output *strings.Builder, name string, err *ParseErr) {
+	r.fail(fmt.Errorf("%s: %w", name, err))
+	output.WriteString("{{error ")
+	output.WriteString(strconv.Quote(err.Msg))
+	output.WriteString("}}")
+}
+
+// rewriteDefine lifts <c-define name="c-x">...</c-define> into a trailer
+// template and registers c-x as a component local to the file, usable in
+// the rest of it. templ follows the tag name; the rest after the closing
+// tag is returned.
+func (r *rewriter) rewriteDefine(output *strings.Builder, src *sourceText, templ string, name string, baseName string) string {
+	var compName string
+	for {
+		templ = trimSpace(templ)
+		if n := scanTagEnd(templ); n >= 0 {
+			templ = templ[n:]
+			break
+		}
+		n := scanAttrName(templ)
+		if n < 0 || templ[:n] != "name" || templ[n] != '=' {
+			r.writeError(output, name, src.errf(templ, "expected name=\"c-...\""))
+			return skipDefine(templ, name, false)
+		}
+		rest := trimSpace(templ[n+1:])
+		if value, n := scanQuoted(rest, '"'); n >= 0 {
+			compName, templ = value, rest[n:]
+		} else if value, n := scanQuoted(rest, '\''); n >= 0 {
+			compName, templ = value, rest[n:]
+		} else if n := scanNakedValue(rest); n >= 0 {
+			compName, templ = rest[:n], rest[n:]
+		} else {
+			r.writeError(output, name, src.errf(rest, "missing value for attr name"))
+			return skipDefine(rest, name, false)
+		}
+	}
+	if !isComponentName(compName) || nameLen(compName) != len(compName) {
+		r.writeError(output, name, src.errf(templ, "invalid component name %q", compName))
+		return skipDefine(templ, name, true)
+	}
+
+	closing := "</" + name + ">"
+	end, afterEnd := findClosingTag(templ, name)
+	if end < 0 {
+		r.writeError(output, name, src.errf(templ, "missing %s", closing))
+		return templ
+	}
+	body, after := templ[:end], templ[afterEnd:]
+	if r.locals[compName] != nil {
+		r.writeError(output, name, src.errf(templ, "%s is already defined", compName))
+		return after
+	}
+	def, err := ScanComponent(body)
+	if err != nil {
+		r.writeError(output, name, src.errf(templ, "%s: %v", compName, err))
+		return after
+	}
+	def.TemplateName = baseName + "__" + compName
+	r.locals[compName] = def
+	r.private = append(r.private, def.TemplateName)
+	r.defines = append(r.defines, def.TemplateName)
+
+	_, code, frontMatterLines, _ := cutFrontMatter(body)
+	var subout strings.Builder
+	r.rewrite(&subout, newSourceText(code, src.lineAt(len(src.text)-len(templ))+frontMatterLines), 0, baseName)
+	fmt.Fprintf(&r.trailers, "{{define %q}}%s{{end}}", def.TemplateName, subout.String())
+	return after
+}
+
+// skipDefine skips the rest of a broken <c-define> element, starting in its
+// attrs or, with inBody, after its start tag. Without a closing tag, only
+// the start tag is skipped.
+func skipDefine(templ string, name string, inBody bool) string {
+	if !inBody {
+		_, tagEnd := findTagEnd(templ)
+		if tagEnd < 0 {
+			return templ
+		}
+		templ = templ[tagEnd:]
+	}
+	if _, end := findClosingTag(templ, name); end >= 0 {
+		return templ[end:]
+	}
+	return templ
+}
+
+// defineBody adds a trailer template with the rewritten code of a body and
+// returns a placeholder for its name, see nameBodies. Names are derived from
+// the body source rather than its position, so that editing one part of a
+// file does not rename the bodies in the rest of it. Identical bodies share
+// a template.
+func (r *rewriter) defineBody(baseName string, c *Component, hash [32]byte, code string, info bodyInfo) string {
+	key := definedBody{code, info}
+	if !r.trackCalls {
+		key.info = bodyInfo{}
+	}
+	if name, found := r.defined[key]; found {
+		return name
+	}
+	name := baseName + "___" + c.Name + "__body__" + hex.EncodeToString(hash[:4])
+	placeholder := name + "#" + strconv.Itoa(len(r.pending))
+	r.pending = append(r.pending, pendingBody{placeholder, name, string(hash[:]) + key.info.Pos, info})
+	r.defined[key] = placeholder
+	fmt.Fprintf(&r.trailers, "{{define %q}}{{with .Data}}%s{{end}}{{end}}", placeholder, code)
+	return placeholder
+}
+
+// bodySpan is a body template defined in the text of an enclosing one.
+type bodySpan struct {
+	state      *sourceState
+	start, end int
+	hash       [32]byte
+}
+
+// bodyHash hashes the tag name and the source of a body that starts at start
+// in src. The bodies defined in it, r.spans[mark:], are hashed in place of
+// their source, so that deeply nested bodies are not hashed over and over.
+func (r *rewriter) bodyHash(name string, src *sourceText, start, mark int) [32]byte {
+	h := sha256.New()
+	io.WriteString(h, name+"\x00")
+	for _, span := range r.spans[mark:] {
+		// bodies of generated code, like that of <c-each>, are hashed as
+		// part of the source they were generated from
+		if span.state != src.sourceState {
+			continue
+		}
+		io.WriteString(h, src.text[start:span.start])
+		h.Write(span.hash[:])
+		start = span.end
+	}
+	io.WriteString(h, src.text[start:])
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// pendingBody is a body template whose final name is chosen by nameBodies.
+type pendingBody struct {
+	placeholder string
+	name        string
+	// source identifies the body by its content and position.
+	source string
+	info   bodyInfo
+}
+
+// nameBodies replaces body name placeholders in code. Bodies that share a
+// source hash but differ in position, e.g. identical tags on different
+// lines, get a suffix derived from their position, so that their names do
+// not depend on which one comes first.
+func (r *rewriter) nameBodies(code string) string {
+	if len(r.pending) == 0 {
+		return code
+	}
+	count := make(map[string]int)
+	for _, b := range r.pending {
+		count[b.name]++
+	}
+	var replacements []string
+	for _, b := range r.pending {
+		name := b.name
+		if count[name] > 1 {
+			h := sha256.Sum256([]byte(b.source))
+			name += "_" + hex.EncodeToString(h[:4])
+		}
+		for base, n := name, 2; ; n++ {
+			if _, taken := r.bodies[name]; !taken {
+				break
+			}
+			name = base + "_" + strconv.Itoa(n)
+		}
+		r.bodies[name] = b.info
+		replacements = append(replacements, strconv.Quote(b.placeholder), strconv.Quote(name))
+	}
+	return strings.NewReplacer(replacements...).Replace(code)
+}
+
+// rewriteBodyPrints makes {{.Args.body}} go through render, which prints
+// lazy bodies, or through write_body, which streams them into the output,
+// when that is safe without contextual escaping. text starts at offset in
+// src.
+func rewriteBodyPrints(src *sourceText, offset int, text string) string {
+	if !strings.Contains(text, ".Args.body") {
+		return text
+	}
+	var buf strings.Builder
+	last := 0
+	for _, m := range bodyPrintRe.FindAllStringSubmatchIndex(text, -1) {
+		buf.WriteString(text[last:m[0]])
+		expr := text[m[4]:m[5]]
+		buf.WriteString("{{")
+		buf.WriteString(text[m[2]:m[3]])
+		if src.isTextAt(offset + m[0]) {
+			rd := "."
+			if strings.HasPrefix(expr, "$") {
+				rd = "$"
+			}
+			buf.WriteString("write_body " + rd + " " + expr)
+		} else {
+			buf.WriteString("render " + expr)
+		}
+		buf.WriteString(text[m[6]:m[7]])
+		buf.WriteString("}}")
+		last = m[1]
+	}
+	buf.WriteString(text[last:])
+	return buf.String()
+}
+
+func checkProps(src *sourceText, templ string, c *Component, props []Prop) *ParseErr {
+	for _, arg := range c.Args {
+		if arg.Name != "data" && findProp(props, arg.Name) < 0 {
+			return src.errf(templ, "unknown prop %s of <%s>", arg.Name, c.Name)
+		}
+	}
+	for _, prop := range props {
+		if !prop.Required {
+			continue
+		}
+		if findArg(c.Args, prop.Name) < 0 && !(prop.Name == "body" && c.Body != "") {
+			return src.errf(templ, "missing required prop %s of <%s>", prop.Name, c.Name)
+		}
+	}
+	return nil
+}
+
+// blockTracker follows the nesting of block actions in template text.
+type blockTracker struct {
+	conditional []bool
+}
+
+func (b *blockTracker) scan(text string) {
+	for {
+		_, rest, found := strings.Cut(text, "{{")
+		if !found {
+			return
+		}
+		action, after, found := strings.Cut(rest, "}}")
+		if !found {
+			return
+		}
+		text = after
+		action = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(action, "-"), "-"))
+		keyword, _, _ := strings.Cut(action, " ")
+		switch keyword {
+		case "if", "range", "with":
+			b.conditional = append(b.conditional, true)
+		case "define", "block":
+			b.conditional = append(b.conditional, false)
+		case "end":
+			if n := len(b.conditional); n > 0 {
+				b.conditional = b.conditional[:n-1]
+			}
+		}
+	}
+}
+
+func (b *blockTracker) guarded() bool {
+	for _, c := range b.conditional {
+		if c {
+			return true
+		}
+	}
+	return false
+}
+
+// bindFunc returns the func that binds the data of a component call. Prepare
+// funcs get a tracked call of their own, so that their errors include the
+// component in the stack.
+func (r *rewriter) bindFunc(compName, pos string) string {
+	if r.trackCalls {
+		return "$.Call " + strconv.Quote(compName) + " " + strconv.Quote(pos)
+	}
+	return "$.Bind"
+}
+
+func writeBindArgs(wr *strings.Builder, args []Arg, dataExpr string, bindFunc string) {
 	dataArgIdx := findArg(args, "data")
 	if dataArgIdx >= 0 {
 		dataExpr = args[dataArgIdx].Value
 	}
 
-	wr.WriteString(" ($.Bind ")
+	wr.WriteString(" (")
+	wr.WriteString(bindFunc)
+	wr.WriteString(" ")
 	wr.WriteString(dataExpr)
 	for i, arg := range args {
 		if i == dataArgIdx {
@@ -359,31 +1092,96 @@ func writeBindExtraArgs(wr *strings.Builder, args []Arg) {
 }
 
 func WrapTemplate(code string, prefix, suffix string) string {
-	var defines string
+	code, defines := splitDefines(code)
+	return prefix + code + suffix + defines
+}
+
+func splitDefines(code string) (main, defines string) {
 	if i := strings.Index(code, "{{define"); i >= 0 {
-		code, defines = code[:i], code[i:]
+		return code[:i], code[i:]
 	}
-	return prefix + code + suffix + defines
+	return code, ""
 }
 
+// ScanTemplate is ScanComponent for callers that don't handle errors: a
+// template with invalid front matter is scanned as if it had none.
 func ScanTemplate(code string) *ComponentDef {
-	return &ComponentDef{
-		RenderMethod: RenderMethodTemplate,
-		HasSlots:     strings.Contains(code, "<c-slot-"),
+	def, err := ScanComponent(code)
+	if err != nil {
+		def, _ = ScanComponent(StripFrontMatter(code))
+	}
+	return def
+}
+
+// ScanComponent returns the def of a component template, taking the render
+// method, props and slots from its front matter, if any.
+func ScanComponent(code string) (*ComponentDef, error) {
+	def := &ComponentDef{}
+	meta, body, frontMatterLines, found := cutFrontMatter(code)
+	if found {
+		if err := parseFrontMatter(meta, def); err != nil {
+			return nil, err
+		}
 	}
+	if def.RenderMethod == RenderMethodNone {
+		if def.FuncName != "" {
+			def.RenderMethod = RenderMethodFuncThenTemplate
+		} else {
+			def.RenderMethod = RenderMethodTemplate
+		}
+	}
+
+	body = withoutDefines(withoutRaw(body))
+	for _, m := range slotRe.FindAllStringSubmatchIndex(body, -1) {
+		slot := body[m[2]:m[3]]
+		if def.Slots != nil && !contains(def.Slots, slot) {
+			err := errf(body, body[m[0]:], "undeclared slot %s", slot)
+			err.Line += frontMatterLines
+			return nil, err
+		}
+		def.HasSlots = true
+	}
+	if len(def.Slots) > 0 {
+		def.HasSlots = true
+	}
+	return def, nil
 }
 
 func rewriteInterpolatedStringAsExpr(str string) (string, bool) {
-	if strings.Contains(str, "<c-") {
+	return rewriteInterpolation(str, false)
+}
+
+// rewriteBodyAsExpr turns a simple body into a concat_html call that
+// produces template.HTML, so that the component can print it as is. Markup
+// comes from the template source and is trusted, while interpolated values
+// are escaped, which is only correct in HTML text context; bodies
+// interpolating into tags, comments, scripts or styles get a template.
+func rewriteBodyAsExpr(str string) (string, bool) {
+	return rewriteInterpolation(str, true)
+}
+
+func rewriteInterpolation(str string, html bool) (string, bool) {
+	if strings.Contains(str, "<c-") || strings.Contains(str, escapedTagPrefix) || strings.Contains(str, rawOffMarker) {
 		return "", false
 	}
 	if !strings.Contains(str, "{{") {
+		if html {
+			return "(concat_html " + strconv.Quote(str) + ")", true
+		}
 		return strconv.Quote(str), true
 	}
 
 	var buf strings.Builder
-	buf.WriteString("(print")
+	if html {
+		buf.WriteString("(concat_html")
+	} else {
+		buf.WriteString("(print")
+	}
 
+	// literal text is accumulated so that concat_html args alternate
+	// between literals and values even around comments
+	var literal string
+	var context htmlContext
 	for {
 		prefix, remainder, found := strings.Cut(str, "{{")
 		if !found {
@@ -392,13 +1190,13 @@ func rewriteInterpolatedStringAsExpr(str string) (string, bool) {
 
 		remainder, trimmingPrefix := strings.CutPrefix(remainder, "- ")
 
-		if prefix != "" {
-			if trimmingPrefix {
-				prefix = strings.TrimRightFunc(prefix, unicode.IsSpace)
-			}
-			buf.WriteByte(' ')
-			buf.WriteString(strconv.Quote(prefix))
+		if trimmingPrefix {
+			prefix = strings.TrimRightFunc(prefix, unicode.IsSpace)
+			literal = strings.TrimRightFunc(literal+prefix, unicode.IsSpace)
+		} else {
+			literal += prefix
 		}
+		context.feed(prefix)
 
 		expr, suffix, found := strings.Cut(remainder, "}}")
 		if !found {
@@ -412,6 +1210,14 @@ func rewriteInterpolatedStringAsExpr(str string) (string, bool) {
 			if isUnconcatenatableExpr(expr) {
 				return "", false
 			}
+			if html && !context.isText() {
+				return "", false
+			}
+			if literal != "" || html {
+				buf.WriteByte(' ')
+				buf.WriteString(strconv.Quote(literal))
+			}
+			literal = ""
 			buf.WriteByte(' ')
 			buf.WriteString(parenthesizeIfNecessary(expr))
 		}
@@ -421,9 +1227,10 @@ func rewriteInterpolatedStringAsExpr(str string) (string, bool) {
 		}
 		str = suffix
 	}
-	if str != "" {
+	literal += str
+	if literal != "" {
 		buf.WriteByte(' ')
-		buf.WriteString(strconv.Quote(str))
+		buf.WriteString(strconv.Quote(literal))
 	}
 
 	buf.WriteString(")")
@@ -439,6 +1246,15 @@ func findArg(args []Arg, name string) int {
 	return -1
 }
 
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func isComment(expr string) bool {
 	return strings.HasPrefix(expr, "/*")
 }
@@ -463,16 +1279,24 @@ var actions = map[string]bool{
 	"block":    true,
 }
 
-var safeSimpleExprRe = regexp.MustCompile(`^[.\w]+$`)
-
 func parenthesizeIfNecessary(expr string) string {
-	if safeSimpleExprRe.MatchString(expr) {
+	if isSimpleExpr(expr) {
 		return expr
 	} else {
 		return "(" + expr + ")"
 	}
 }
 
+// isSimpleExpr matches ^[.\w]+$.
+func isSimpleExpr(expr string) bool {
+	for i := 0; i < len(expr); i++ {
+		if b := expr[i]; !(b == '.' || b == '_' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9') {
+			return false
+		}
+	}
+	return expr != ""
+}
+
 func skipSpace(s string) (string, bool) {
 	r := trimSpace(s)
 	return r, len(r) != len(s)
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 )
@@ -42,35 +45,80 @@ func TestRewrite(t *testing.T) {
 
 		{"", `foo <c-test /> bar <c-another/> boz`, `foo {{template "c-test" ($.Bind nil)}} bar {{template "c-another" ($.Bind nil)}} boz`, `foo TEST bar ANOTHER boz`},
 
+		{"escaped tag", `foo <\c-test/> <c-test/>`, `foo <c-test/> {{template "c-test" ($.Bind nil)}}`, `foo <c-test/> TEST`},
+		{"raw", `foo <c-raw><c-test/> <c-xxx></c-raw> <c-test/>`, `foo <c-test/> <c-xxx> {{template "c-test" ($.Bind nil)}}`, `foo <c-test/> <c-xxx> TEST`},
+		{"raw region", "foo {{/* minicomponents:off */}}<c-test/>{{/* minicomponents:on */}} <c-test/>", `foo <c-test/> {{template "c-test" ($.Bind nil)}}`, `foo <c-test/> TEST`},
+		{"define", `<c-define name="c-pair"><b>{{$@a}}</b></c-define><c-pair a="x" />`, `{{template "mypage__c-pair" ($.Bind nil "a" "x")}}{{define "mypage__c-pair"}}<b>{{$.Args.a}}</b>{{end}}`, `<b>x</b>`},
+		{"define slots", "<c-define name=c-wrap>\n<i><c-slot-body/></i></c-define><c-wrap>hi</c-wrap>", `{{template "mypage__c-wrap" ($.Bind . "bodyTemplate" "mypage___c-wrap__body__f7bb6c55")}}{{define "mypage__c-wrap"}}` + "\n" + `<i>{{write_eval $.Args.bodyTemplate ($.Bind (or $.Args.callerData $.Data))}}</i>{{end}}{{define "mypage___c-wrap__body__f7bb6c55"}}{{with .Data}}hi{{end}}{{end}}`, "\n<i>hi</i>"},
+		{"define overrides", `<c-define name="c-test">local</c-define><c-test/>`, `{{template "mypage__c-test" ($.Bind nil)}}{{define "mypage__c-test"}}local{{end}}`, `local`},
+		{"define twice", `<c-define name="c-x"></c-define><c-define name="c-x"></c-define>`, `{{error "c-x is already defined"}}{{define "mypage__c-x"}}{{end}}`, `ERROR`},
+		{"define bad name", `<c-define name="x"><c-test/></c-define>after`, `{{error "invalid component name \"x\""}}after`, `ERRORafter`},
+		{"define bad attr", `<c-define title="x"><c-test/></c-define>after`, `{{error "expected name=\"c-...\""}}after`, `ERRORafter`},
+		{"define nested", `<c-define name="c-x"><c-define name="c-y">y</c-define><c-y/></c-define><c-x/>`, `{{template "mypage__c-x" ($.Bind nil)}}{{define "mypage__c-y"}}y{{end}}{{define "mypage__c-x"}}{{template "mypage__c-y" ($.Bind nil)}}{{end}}`, `y`},
+		{"define unterminated", `<c-define name="c-x"><c-test/>`, `{{error "missing </c-define>"}}{{template "c-test" ($.Bind nil)}}`, `ERRORTEST`},
+		{"define use before", `<c-x/><c-define name="c-x"></c-define>`, `{{error "unknown component <c-x>"}}{{define "mypage__c-x"}}{{end}}`, `ERROR`},
+		{"escaped tag in body", `<c-test>a <\c-x> b</c-test>`, `{{template "c-test" ($.Bind . "body" (lazy_eval "mypage___c-test__body__4d2169ba" ($.Bind .)))}}{{define "mypage___c-test__body__4d2169ba"}}{{with .Data}}a <c-x> b{{end}}{{end}}`, `TEST`},
+		{"for", `<c-for each={{.Items}}>[{{.}}]</c-for>`, `{{range (.Items)}}[{{.}}]{{end}}`, `[a][b]`},
+		{"for as", `<c-for each={{.Items}} as="item" index=i>{{$i}}={{$item}} <c-test/></c-for>`, `{{range $i, $item := (.Items)}}{{$i}}={{$item}} {{template "c-test" ($.Bind nil)}}{{end}}`, `0=a TEST1=b TEST`},
+		{"for index", `<c-for each={{.Items}} index="i">{{$i}}</c-for>`, `{{range $i, $_ := (.Items)}}{{$i}}{{end}}`, `01`},
+		{"for else", `<c-for each={{.None}}>x<c-else>empty</c-for>`, `{{range (.None)}}x{{else}}empty{{end}}`, `empty`},
+		{"if", `<c-if cond={{.Foo}}>yes<c-else-if cond={{.Good}}>good<c-else/>no</c-if>`, `{{if (.Foo)}}yes{{else if (.Good)}}good{{else}}no{{end}}`, `yes`},
+		{"nested if", `<c-if cond={{.None}}>a<c-else><c-if cond={{.Foo}}>b<c-else>c</c-if>d</c-if>`, `{{if (.None)}}a{{else}}{{if (.Foo)}}b{{else}}c{{end}}d{{end}}`, `bd`},
+		{"if in body", `<c-simple><c-if cond={{.Foo}}>{{.Name}}</c-if></c-simple>`, `{{template "c-simple" ($.Bind . "bodyTemplate" "mypage___c-simple__body__6042386e")}}{{define "mypage___c-simple__body__6042386e"}}{{with .Data}}{{if (.Foo)}}{{.Name}}{{end}}{{end}}{{end}}`, `<simple>&lt;Bob &amp; Co&gt;</simple>`},
+		{"else outside", `a<c-else>b`, `a{{error "<c-else> must be directly inside <c-if> or <c-for>, once"}}b`, `aERRORb`},
+		{"else in body", `<c-if cond={{.Foo}}><c-test><c-else/></c-test></c-if>`, `{{if (.Foo)}}{{template "c-test" ($.Bind . "body" (lazy_eval "mypage___c-test__body__99a982f1" ($.Bind .)))}}{{end}}{{define "mypage___c-test__body__99a982f1"}}{{with .Data}}{{error "<c-else> must be directly inside <c-if> or <c-for>, once"}}{{end}}{{end}}`, `TEST`},
+		{"else-if after else", `<c-if cond={{.Foo}}>a<c-else>b<c-else-if cond={{.Good}}>c</c-if>`, `{{if (.Foo)}}a{{else}}b{{error "<c-else-if> must be directly inside <c-if>, before <c-else>"}}c{{end}}`, `a`},
+		{"for without each", `<c-for as=x>a</c-for>`, `{{error "missing each attr"}}`, `ERROR`},
+		{"for var in slot body", `<c-for each={{.Items}} as="item" index="i"><c-box>{{$i}}: {{$item}}</c-box></c-for>`, `{{range $i, $item := (.Items)}}{{error "$i of the enclosing <c-for> is not available in the body of <c-box>, which renders as a separate template"}}{{end}}`, `ERRORERROR`},
+		{"for var in inline body", `<c-for each={{.Items}} as="item"><c-test>{{$item}}</c-test><c-box><c-for each={{.Items}} as="item">{{$item}}</c-for></c-box></c-for>`, `{{range $item := (.Items)}}{{template "c-test" ($.Bind nil "body" (concat_html "" ($item)))}}{{template "c-box" ($.Bind . "bodyTemplate" "mypage___c-box__body__b2e4fb46")}}{{end}}{{define "mypage___c-box__body__b2e4fb46"}}{{with .Data}}{{range $item := (.Items)}}{{$item}}{{end}}{{end}}{{end}}`, `TEST<box>|</box>TEST<box>|</box>`},
+		{"for var in nested slot body", `<c-for each={{.Items}} as="item"><c-box><c-box>{{$item}}</c-box></c-box></c-for>`, `{{range $item := (.Items)}}{{template "c-box" ($.Bind . "bodyTemplate" "mypage___c-box__body__5f6aa9b3")}}{{end}}{{define "mypage___c-box__body__5f6aa9b3"}}{{with .Data}}{{error "$item of the enclosing <c-for> is not available in the body of <c-box>, which renders as a separate template"}}{{end}}{{end}}`, `<box>|</box><box>|</box>`},
+		{"for bad var", `<c-for each={{.Items}} as="x y">a</c-for>`, `{{error "as must be a variable name, got \"x y\""}}`, `ERROR`},
+		{"if unknown attr", `<c-if test={{.Foo}}>a</c-if>`, `{{error "unknown attr test"}}`, `ERROR`},
+		{"if naked cond", `<c-if cond=.Foo>a</c-if>`, `{{error "cond must be a {{...}} expression, got \".Foo\""}}`, `ERROR`},
+		{"else-if quoted cond", `<c-if cond={{.Foo}}>a<c-else-if cond="{{.Good}}">b</c-if>`, `{{if (.Foo)}}a{{error "cond must be a {{...}} expression, got (print .Good)"}}b{{end}}`, `aERRORb`},
+		{"for naked each", `<c-for each=.Items>a</c-for>`, `{{error "each must be a {{...}} expression, got \".Items\""}}`, `ERROR`},
+		{"nested same name", `<c-box first="1" second="2"><c-box first="3" second="4">{{.}}</c-box></c-box>`, `{{template "c-box" ($.Bind . "first" "1" "second" "2" "bodyTemplate" "mypage___c-box__body__c72576b4")}}{{define "mypage___c-box__body__c52a3020"}}{{with .Data}}{{.}}{{end}}{{end}}{{define "mypage___c-box__body__c72576b4"}}{{with .Data}}{{template "c-box" ($.Bind . "first" "3" "second" "4" "bodyTemplate" "mypage___c-box__body__c52a3020")}}{{end}}{{end}}`, `<box><box>3|4</box>|<box>3|4</box></box>`},
+		{"raw unterminated", `foo <c-raw><c-test/>`, `foo {{error "missing </c-raw>"}}{{template "c-test" ($.Bind nil)}}`, `foo ERRORTEST`},
+		{"raw region unterminated", `foo {{/* minicomponents:off */}}<c-test/>`, `foo {{error "missing {{/* minicomponents:on */}}"}}{{template "c-test" ($.Bind nil)}}`, `foo ERRORTEST`},
+
 		{"", `foo <c-foo abc="42" test /> bar`, `foo {{render_foo ($.Bind nil "abc" "42" "test" true)}} bar`, `foo FOO bar`},
 
-		{"", `start <c-bar /> end`, `start {{template "c-bar" ($.Bind (prep_bar ($.Bind nil)))}} end`, `start <bar first="bar" second="42" third="" /> end`},
-		{"", `start <c-bar first="boz" third="fubar" /> end`, `start {{template "c-bar" ($.Bind (prep_bar ($.Bind nil "first" "boz" "third" "fubar")))}} end`, `start <bar first="boz" second="42" third="fubar" /> end`},
+		{"", `start <c-bar /> end`, `start {{template "c-bar" ($.Bind (prep_bar ($.Bind nil)) "callerData" .)}} end`, `start <bar first="bar" second="42" third="" /> end`},
+		{"", `start <c-bar first="boz" third="fubar" /> end`, `start {{template "c-bar" ($.Bind (prep_bar ($.Bind nil "first" "boz" "third" "fubar")) "callerData" .)}} end`, `start <bar first="boz" second="42" third="fubar" /> end`},
 
 		{"", `foo <c-xxx /> bar`, `foo {{error "unknown component <c-xxx>"}} bar`, `foo ERROR bar`},
 
-		{"", `foo <c-test>bar</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" "bar")}} boz`, `foo TEST boz`},
+		{"", `foo <c-test>bar</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (concat_html "bar"))}} boz`, `foo TEST boz`},
 
-		{"", `foo <c-test>ba{{.test}}r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (print "ba" .test "r"))}} boz`, `foo TEST boz`},
-		{"", `foo <c-test>ba{{.test.foo}}r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (print "ba" .test.foo "r"))}} boz`, `foo TEST boz`},
-		{"", `foo <c-test>ba{{ .test }}r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (print "ba" .test "r"))}} boz`, `foo TEST boz`},
-		{"", `foo <c-test>ba{{.test | brackets}}r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (print "ba" (.test | brackets) "r"))}} boz`, `foo TEST boz`},
-		{"", `foo <c-test>ba {{.test}} r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (print "ba " .test " r"))}} boz`, `foo TEST boz`},
-		{"", `foo <c-test>ba {{- .test}} r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (print "ba" .test " r"))}} boz`, `foo TEST boz`},
-		{"", `foo <c-test>ba {{- .test -}} r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (print "ba" .test "r"))}} boz`, `foo TEST boz`},
+		{"", `foo <c-test>ba{{.test}}r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (concat_html "ba" .test "r"))}} boz`, `foo TEST boz`},
+		{"", `foo <c-test>ba{{.test.foo}}r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (concat_html "ba" .test.foo "r"))}} boz`, `foo TEST boz`},
+		{"", `foo <c-test>ba{{ .test }}r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (concat_html "ba" .test "r"))}} boz`, `foo TEST boz`},
+		{"", `foo <c-test>ba{{.test | brackets}}r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (concat_html "ba" (.test | brackets) "r"))}} boz`, `foo TEST boz`},
+		{"", `foo <c-test>ba {{.test}} r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (concat_html "ba " .test " r"))}} boz`, `foo TEST boz`},
+		{"", `foo <c-test>ba {{- .test}} r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (concat_html "ba" .test " r"))}} boz`, `foo TEST boz`},
+		{"", `foo <c-test>ba {{- .test -}} r</c-test> boz`, `foo {{template "c-test" ($.Bind nil "body" (concat_html "ba" .test "r"))}} boz`, `foo TEST boz`},
+		{"inline body escapes values", `foo <c-button><b>{{.Name}}</b></c-button> bar`, `foo {{template "c-button" ($.Bind nil "body" (concat_html "<b>" .Name "</b>"))}} bar`, `foo <button><b>&lt;Bob &amp; Co&gt;</b></button> bar`},
+		{"inline body starting with a value", `foo <c-button>{{.Name}}{{/* c */}}{{.Name}}!</c-button> bar`, `foo {{template "c-button" ($.Bind nil "body" (concat_html "" .Name "" .Name "!"))}} bar`, `foo <button>&lt;Bob &amp; Co&gt;&lt;Bob &amp; Co&gt;!</button> bar`},
+		{"value in attribute needs a body template", `foo <c-button><a title="{{.Name}}">x</a></c-button> bar`, `foo {{template "c-button" ($.Bind . "body" (lazy_eval "mypage___c-button__body__0282bee9" ($.Bind .)))}} bar{{define "mypage___c-button__body__0282bee9"}}{{with .Data}}<a title="{{.Name}}">x</a>{{end}}{{end}}`, `foo <button><a title="&lt;Bob &amp; Co&gt;">x</a></button> bar`},
 		{"", `foo <c-test abc="xy{{.test}}z" /> bar`, `foo {{template "c-test" ($.Bind nil "abc" (print "xy" .test "z"))}} bar`, `foo TEST bar`},
 		{"", `foo <c-test abc='xy{{.test}}z' /> bar`, `foo {{template "c-test" ($.Bind nil "abc" (print "xy" .test "z"))}} bar`, `foo TEST bar`},
 
-		{"eval'ed template body for unsuspecting component", `foo <c-button>{{if .Good}}green{{else}}red{{end}}</c-button> bar`, `foo {{template "c-button" ($.Bind . "body" (eval "mypage___c-button__body__1" ($.Bind .)))}} bar{{define "mypage___c-button__body__1"}}{{with .Data}}{{if .Good}}green{{else}}red{{end}}{{end}}{{end}}`, `foo <button>green</button> bar`},
+		{"eval'ed template body for unsuspecting component", `foo <c-button>{{if .Good}}green{{else}}red{{end}}</c-button> bar`, `foo {{template "c-button" ($.Bind . "body" (lazy_eval "mypage___c-button__body__13fd597b" ($.Bind .)))}} bar{{define "mypage___c-button__body__13fd597b"}}{{with .Data}}{{if .Good}}green{{else}}red{{end}}{{end}}{{end}}`, `foo <button>green</button> bar`},
+
+		{"slot component body", `foo <c-slot-body /> bar <c-slot-another data="hello" /> boz`, `foo {{write_eval $.Args.bodyTemplate ($.Bind (or $.Args.callerData $.Data))}} bar {{write_eval $.Args.anotherTemplate ($.Bind "hello")}} boz`, `foo TEST bar <button>hello</button> boz`},
+		{"slot body in attribute is not streamed", `foo <a title="<c-slot-body />"> bar`, `foo <a title="{{eval $.Args.bodyTemplate ($.Bind (or $.Args.callerData $.Data))}}"> bar`, `foo <a title="TEST"> bar`},
+		{"slot component body with extra arg", `foo <c-slot-body answer={{42}} /> bar`, `foo {{write_eval $.Args.bodyTemplate ($.Bind (or $.Args.callerData $.Data) "answer" (42))}} bar`, `foo TEST bar`},
+		{"slot component body with data override and arg", `foo <c-slot-body data="hello" answer={{42}} /> bar`, `foo {{write_eval $.Args.bodyTemplate ($.Bind "hello" "answer" (42))}} bar`, `foo TEST bar`},
 
-		{"slot component body", `foo <c-slot-body /> bar <c-slot-another data="hello" /> boz`, `foo {{eval $.Args.bodyTemplate ($.Bind $.Data)}} bar {{eval $.Args.anotherTemplate ($.Bind "hello")}} boz`, `foo TEST bar <button>hello</button> boz`},
-		{"slot component body with extra arg", `foo <c-slot-body answer={{42}} /> bar`, `foo {{eval $.Args.bodyTemplate ($.Bind $.Data "answer" (42))}} bar`, `foo TEST bar`},
-		{"slot component body with data override and arg", `foo <c-slot-body data="hello" answer={{42}} /> bar`, `foo {{eval $.Args.bodyTemplate ($.Bind "hello" "answer" (42))}} bar`, `foo TEST bar`},
+		{"slot component", `foo <c-box first="hello" second="world">“{{.}}”</c-box> bar`, `foo {{template "c-box" ($.Bind . "first" "hello" "second" "world" "bodyTemplate" "mypage___c-box__body__d6f58214")}} bar{{define "mypage___c-box__body__d6f58214"}}{{with .Data}}“{{.}}”{{end}}{{end}}`, `foo <box>“hello”|“world”</box> bar`},
+		{"two slot component calls", `foo <c-simple>A</c-simple> bar <c-simple>B</c-simple> boz`, `foo {{template "c-simple" ($.Bind . "bodyTemplate" "mypage___c-simple__body__8d0a95ec")}} bar {{template "c-simple" ($.Bind . "bodyTemplate" "mypage___c-simple__body__b4b8b631")}} boz{{define "mypage___c-simple__body__8d0a95ec"}}{{with .Data}}A{{end}}{{end}}{{define "mypage___c-simple__body__b4b8b631"}}{{with .Data}}B{{end}}{{end}}`, `foo <simple>A</simple> bar <simple>B</simple> boz`},
 
-		{"slot component", `foo <c-box first="hello" second="world">“{{.}}”</c-box> bar`, `foo {{template "c-box" ($.Bind . "first" "hello" "second" "world" "bodyTemplate" "mypage___c-box__body__1")}} bar{{define "mypage___c-box__body__1"}}{{with .Data}}“{{.}}”{{end}}{{end}}`, `foo <box>“hello”|“world”</box> bar`},
-		{"two slot component calls", `foo <c-simple>A</c-simple> bar <c-simple>B</c-simple> boz`, `foo {{template "c-simple" ($.Bind . "bodyTemplate" "mypage___c-simple__body__1")}} bar {{template "c-simple" ($.Bind . "bodyTemplate" "mypage___c-simple__body__2")}} boz{{define "mypage___c-simple__body__1"}}{{with .Data}}A{{end}}{{end}}{{define "mypage___c-simple__body__2"}}{{with .Data}}B{{end}}{{end}}`, `foo <simple>A</simple> bar <simple>B</simple> boz`},
+		{"declared props", `foo <c-card title="x" data={{.}} /> bar`, `foo {{template "c-card" ($.Bind (.) "title" "x")}} bar`, `foo CARD bar`},
+		{"unknown prop", `foo <c-card title="x" color="red" /> bar`, `foo {{error "unknown prop color of <c-card>"}} bar`, `foo ERROR bar`},
+		{"missing required prop", `foo <c-card /> bar`, `foo {{error "missing required prop title of <c-card>"}} bar`, `foo ERROR bar`},
+		{"front matter is content in pages", "---\nprops: a\n---\nfoo <c-test/> bar", "---\nprops: a\n---\n" + `foo {{template "c-test" ($.Bind nil)}} bar`, "---\nprops: a\n---\nfoo TEST bar"},
 
-		{"component within component", `foo <c-button><c-test/> xxx</c-button> bar`, `foo {{template "c-button" ($.Bind . "body" (eval "mypage___c-button__body__1" ($.Bind .)))}} bar{{define "mypage___c-button__body__1"}}{{with .Data}}{{template "c-test" ($.Bind nil)}} xxx{{end}}{{end}}`, `foo <button>TEST xxx</button> bar`},
+		{"component within component", `foo <c-button><c-test/> xxx</c-button> bar`, `foo {{template "c-button" ($.Bind . "body" (lazy_eval "mypage___c-button__body__73872adb" ($.Bind .)))}} bar{{define "mypage___c-button__body__73872adb"}}{{with .Data}}{{template "c-test" ($.Bind nil)}} xxx{{end}}{{end}}`, `foo <button>TEST xxx</button> bar`},
 	}
 	comps := map[string]*ComponentDef{
 		"c-test":    {RenderMethod: RenderMethodTemplate},
@@ -80,6 +128,7 @@ func TestRewrite(t *testing.T) {
 		"c-button":  {RenderMethod: RenderMethodTemplate},
 		"c-box":     {RenderMethod: RenderMethodTemplate, HasSlots: true},
 		"c-simple":  {RenderMethod: RenderMethodTemplate, HasSlots: true},
+		"c-card":    {RenderMethod: RenderMethodTemplate, Props: []Prop{{Name: "title", Required: true}, {Name: "kind"}}},
 	}
 	for _, tt := range tests {
 		if tt.name == "" {
@@ -94,11 +143,20 @@ func TestRewrite(t *testing.T) {
 			}
 
 			root := template.New("")
+			eval := func(templateName string, data any) (template.HTML, error) {
+				t.Logf("eval %q with %s", templateName, must(json.Marshal(data)))
+				var buf strings.Builder
+				err := root.ExecuteTemplate(&buf, templateName, data)
+				if err != nil {
+					return "", err
+				}
+				return template.HTML(buf.String()), nil
+			}
 			root.Funcs(template.FuncMap{
 				"render_foo": func(v any) template.HTML {
 					return "FOO"
 				},
-				"prep_bar": func(rd *renderData) map[string]any {
+				"prep_bar": func(rd *RenderData) map[string]any {
 					if _, ok := rd.Args["first"]; !ok {
 						rd.Args["first"] = "bar"
 					}
@@ -113,15 +171,16 @@ func TestRewrite(t *testing.T) {
 				"brackets": func(v any) string {
 					return fmt.Sprintf("[%v]", v)
 				},
-				"eval": func(templateName string, data any) (template.HTML, error) {
-					t.Logf("eval %q with %s", templateName, must(json.Marshal(data)))
-					var buf strings.Builder
-					err := root.ExecuteTemplate(&buf, templateName, data)
-					if err != nil {
-						return "", err
-					}
-					return template.HTML(buf.String()), nil
+				"eval":       eval,
+				"write_eval": eval,
+				"write_body": writeBody,
+				"lazy_eval": func(templateName string, data any) *Body {
+					return &Body{render: func(w io.Writer) error {
+						return root.ExecuteTemplate(w, templateName, data)
+					}}
 				},
+				"render":      renderValue,
+				"concat_html": concatHTML,
 				"error": func(message string) string {
 					return "ERROR"
 				},
@@ -129,7 +188,8 @@ func TestRewrite(t *testing.T) {
 			page := must(root.New("mypage").Parse(WrapTemplate(tt.expCode, "{{with .Data}}", "{{end}}")))
 			must(root.New("c-test").Parse(`TEST`))
 			must(root.New("c-another").Parse(`ANOTHER`))
-			must(root.New("c-button").Parse(`<button>{{.Args.body}}</button>`))
+			must(root.New("c-card").Parse(`CARD`))
+			must(root.New("c-button").Parse(must(Rewrite(`<button>{{.Args.body}}</button>`, "c-button", comps))))
 			must(root.New("c-simple").Parse(`<simple>{{eval .Args.bodyTemplate ($.Bind $.Data)}}</simple>`))
 			must(root.New("c-box").Parse(`<box>{{eval .Args.bodyTemplate ($.Bind .Args.first)}}|{{eval .Args.bodyTemplate ($.Bind .Args.second)}}</box>`))
 			// for testing component bodies
@@ -137,10 +197,13 @@ func TestRewrite(t *testing.T) {
 			must(root.New("c-bar").Parse(`{{with .Data}}<bar first="{{.first}}" second="{{.second}}" third="{{.third}}" />{{end}}`))
 
 			var out strings.Builder
-			err := page.Execute(&out, &renderData{
+			err := page.Execute(&out, &RenderData{
 				Data: map[string]any{
-					"Foo":  true,
-					"Good": true,
+					"Foo":   true,
+					"Good":  true,
+					"Name":  "<Bob & Co>",
+					"Items": []string{"a", "b"},
+					"None":  []string{},
 				},
 				Args: map[string]any{
 					// for testing component bodies
@@ -157,6 +220,250 @@ func TestRewrite(t *testing.T) {
 	}
 }
 
+func TestScanComponent(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		exp    *ComponentDef
+		expErr string
+	}{
+		{"plain", `<div></div>`, &ComponentDef{RenderMethod: RenderMethodTemplate}, ""},
+		{"slots", `<div><c-slot-body/></div>`, &ComponentDef{RenderMethod: RenderMethodTemplate, HasSlots: true}, ""},
+		{"yaml-ish", "---\nprops: title, kind\nrequired: title\nslots: body\nfunc: prep_card\n---\n<div><c-slot-body/></div>", &ComponentDef{
+			RenderMethod: RenderMethodFuncThenTemplate,
+			FuncName:     "prep_card",
+			HasSlots:     true,
+			Props:        []Prop{{Name: "title", Required: true}, {Name: "kind"}},
+			Slots:        []string{"body"},
+		}, ""},
+		{"yaml lists", "---\n# card\nprops:\n  - title\n  - 'kind'\ntemplate: card-impl\n---\n", &ComponentDef{
+			RenderMethod: RenderMethodTemplate,
+			TemplateName: "card-impl",
+			Props:        []Prop{{Name: "title"}, {Name: "kind"}},
+		}, ""},
+		{"toml-ish", "---\nprops = [\"title\", \"kind\"]\nrender = \"func\"\n---\n", &ComponentDef{
+			RenderMethod: RenderMethodFunc,
+			Props:        []Prop{{Name: "title"}, {Name: "kind"}},
+		}, ""},
+		{"json", "---\n{\"props\": [\"title\"], \"func\": \"prep\"}\n---\n", &ComponentDef{
+			RenderMethod: RenderMethodFuncThenTemplate,
+			FuncName:     "prep",
+			Props:        []Prop{{Name: "title"}},
+		}, ""},
+		{"no props", "---\nprops: []\n---\n", &ComponentDef{RenderMethod: RenderMethodTemplate, Props: []Prop{}}, ""},
+		{"unterminated is not front matter", "---\nprops: a\n", &ComponentDef{RenderMethod: RenderMethodTemplate}, ""},
+
+		{"unknown key", "---\nprop: a\n---\n", nil, `line 2: front matter: unknown key "prop"`},
+		{"bad line", "---\nprops: a\nwhat\n---\n", nil, `line 3: front matter: expected key: value, got "what"`},
+		{"bad render", "---\nprops: a\n\nrender: magic\n---\n", nil, `line 4: front matter: unknown render method "magic"`},
+		{"first error in source order", "---\nzzz: a\naaa: b\n---\n", nil, `line 2: front matter: unknown key "zzz"`},
+		{"json unknown key", "---\n{\n  \"props\": [\"a\"],\n  \"prop\": \"b\"\n}\n---\n", nil, `line 4: front matter: unknown key "prop"`},
+		{"json bad value", "---\n{\"props\": [\"a\"],\n\"func\": 1}\n---\n", nil, `line 3: front matter: func must be a string or a list of strings`},
+		{"json syntax", "---\n{\"props\": [\"a\"],\n\"func\" \"x\"}\n---\n", nil, `line 3: front matter: invalid character '"' after object key`},
+		{"raw slot", "<div><c-raw><c-slot-footer/></c-raw></div>", &ComponentDef{RenderMethod: RenderMethodTemplate}, ""},
+
+		{"define slot", "<c-define name=c-x><c-slot-footer/></c-define><div></div>", &ComponentDef{RenderMethod: RenderMethodTemplate}, ""},
+		{"nested define slot", "<c-define name=c-x><c-define name=c-y></c-define><c-slot-footer/></c-define><div></div>", &ComponentDef{RenderMethod: RenderMethodTemplate}, ""},
+		{"tag named like define", "<c-defined-term/><c-slot-body/>", &ComponentDef{RenderMethod: RenderMethodTemplate, HasSlots: true}, ""},
+		{"undeclared slot", "---\nslots: body\n---\n<div>\n<c-slot-footer/></div>", nil, `line 5: undeclared slot footer`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := ScanComponent(tt.input)
+			if tt.expErr != "" {
+				if err == nil || err.Error() != tt.expErr {
+					t.Fatalf("** ScanComponent(%q) error = %v, expected %s", tt.input, err, tt.expErr)
+				}
+				if def := ScanTemplate(tt.input); def == nil {
+					t.Errorf("** ScanTemplate(%q) returned nil", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("** ScanComponent(%q) failed: %v", tt.input, err)
+			}
+			if a, e := fmt.Sprintf("%+v", *actual), fmt.Sprintf("%+v", *tt.exp); a != e {
+				t.Errorf("** ScanComponent(%q) returned:\n\t%s\nexpected:\n\t%s", tt.input, a, e)
+			}
+			if a, e := fmt.Sprintf("%+v", *ScanTemplate(tt.input)), fmt.Sprintf("%+v", *tt.exp); a != e {
+				t.Errorf("** ScanTemplate(%q) returned:\n\t%s\nexpected:\n\t%s", tt.input, a, e)
+			}
+		})
+	}
+}
+
+func TestExpandShorthands(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{{$@title}} {{template "@@__row" .}}`, `{{$.Args.title}} {{template "page__row" .}}`},
+		{`mail me@@__x.com or run "$@"`, `mail me@@__x.com or run "$@"`},
+		{`<script>f("$@")</script>{{$@a}}`, `<script>f("$@")</script>{{$.Args.a}}`},
+		{`<c-@@__row title={{$@title}} text="$@"></c-@@__row>`, `<c-@@__row title={{$.Args.title}} text="$@"></c-@@__row>`},
+		{`{{"}}$@"}} $@ {{$@x}}`, `{{"}}$@"}} $@ {{$.Args.x}}`},
+		{"{{printf `$@%s` $@x 'x'}}", "{{printf `$@%s` $.Args.x 'x'}}"},
+		{`<c-raw>{{$@x}}</c-raw> {{$@y}}`, `<c-raw>{{$@x}}</c-raw> {{$.Args.y}}`},
+		{`{{/* minicomponents:off */}}{{$@x}}{{/* minicomponents:on */}}{{$@y}}`, `{{/* minicomponents:off */}}{{$@x}}{{/* minicomponents:on */}}{{$.Args.y}}`},
+		{`{{/* $@ }} */}} $@`, `{{/* $@ }} */}} $@`},
+		{`{{$@x`, `{{$@x`},
+	}
+	for _, tt := range tests {
+		if actual, _ := expandShorthands(tt.input, "page"); actual != tt.expected {
+			t.Errorf("** expandShorthands(%s) returned:\n\t%s\nexpected:\n\t%s", tt.input, actual, tt.expected)
+		}
+	}
+	if _, a := expandShorthands(`{{template "@@__row" .}} {{define "@@__cell"}}{{end}}`, "page"); fmt.Sprint(a) != "[page__row page__cell]" {
+		t.Errorf("** expandShorthands returned private names %v", a)
+	}
+}
+
+func TestCutStyles(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expCode  string
+		expStyle string
+	}{
+		{"none", `<div></div>`, `<div></div>`, ``},
+		{"global", "<style>\n.card { color: red }\n</style>\n<div class=\"card\"></div>", "\n\n\n<div class=\"card\"></div>", `.card { color: red }`},
+		{"scoped", "<style scoped>.card, ul > li:hover::before { color: red } @media (min-width: 1px) { a[href] { x: y } } @keyframes k { from { x: y } }</style><div class=\"card\"><c-icon /><a href=\"{{.}}\">x</a></div><script>a<b</script>",
+			`<div data-c-XXX class="card"><c-icon /><a data-c-XXX href="{{.}}">x</a></div><script data-c-XXX>a<b</script>`,
+			`.card[data-c-XXX], ul > li[data-c-XXX]:hover::before { color: red } @media (min-width: 1px) { a[href][data-c-XXX] { x: y } } @keyframes k { from { x: y } }`},
+		{"stylesheet lookalike", `<styles></styles>`, `<styles></styles>`, ``},
+		{"scoped raw", "<style scoped>p { x: y }</style><c-raw><p>raw</p></c-raw><p>a</p>{{/* minicomponents:off */}}<p>off</p>{{/* minicomponents:on */}}",
+			`<c-raw><p>raw</p></c-raw><p data-c-XXX>a</p>{{/* minicomponents:off */}}<p>off</p>{{/* minicomponents:on */}}`, `p[data-c-XXX] { x: y }`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, style := cutStyles("c-card", tt.input)
+			attr := hashString("c-card")[:8]
+			code, style = strings.ReplaceAll(code, attr, "XXX"), strings.ReplaceAll(style, attr, "XXX")
+			if code != tt.expCode {
+				t.Errorf("** code:\n\t%s\nexpected:\n\t%s", code, tt.expCode)
+			}
+			if style != tt.expStyle {
+				t.Errorf("** style:\n\t%s\nexpected:\n\t%s", style, tt.expStyle)
+			}
+		})
+	}
+}
+
+func TestCutScripts(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		expCode    string
+		expScripts []string
+	}{
+		{"none", `<div></div>`, `<div></div>`, nil},
+		{"classic", "<div></div>\n<script>\nfoo()\n</script>x", "<div></div>\n\n\nx", []string{"<script>\nfoo()\n</script>"}},
+		{"module and src", `<SCRIPT type="module">import x from "y"</SCRIPT><script src="/lib.js" defer></script>`, ``,
+			[]string{`<script type="module">import x from "y"</script>`, `<script src="/lib.js" defer></script>`}},
+		{"templated", `<script>var id = {{.ID}}</script><script data-id="{{.ID}}">x()</script>`, `<script>var id = {{.ID}}</script><script data-id="{{.ID}}">x()</script>`, nil},
+		{"data block", `<script type="application/json">{}</script><script type='text/javascript'>x()</script>`, `<script type="application/json">{}</script>`, []string{`<script type='text/javascript'>x()</script>`}},
+		{"empty", `<script> </script>`, ``, nil},
+		{"raw", `<c-raw><script>x()</script></c-raw>`, `<c-raw><script>x()</script></c-raw>`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, scripts := cutScripts(tt.input)
+			if code != tt.expCode {
+				t.Errorf("** code:\n\t%s\nexpected:\n\t%s", code, tt.expCode)
+			}
+			if !reflect.DeepEqual(scripts, tt.expScripts) {
+				t.Errorf("** scripts:\n\t%q\nexpected:\n\t%q", scripts, tt.expScripts)
+			}
+		})
+	}
+}
+
+func TestRewriteErrorLine(t *testing.T) {
+	_, err := Rewrite("---\nprops: a\n---\nfoo\n<c-xxx />", "c-mine", nil)
+	if err == nil || err.Error() != "c-xxx: line 5: unknown component <c-xxx>" {
+		t.Errorf("** Rewrite error = %v", err)
+	}
+}
+
+func TestRewriteFrontMatter(t *testing.T) {
+	code, err := Rewrite("---\ntitle: hi\n---\n<h1>x</h1>", "page", nil)
+	if err != nil || code != "---\ntitle: hi\n---\n<h1>x</h1>" {
+		t.Errorf("** Rewrite of a page returned %q, %v", code, err)
+	}
+	code, err = Rewrite("---\nprops: a\n---\n<h1>x</h1>", "c-mine", nil)
+	if err != nil || code != "<h1>x</h1>" {
+		t.Errorf("** Rewrite of a component returned %q, %v", code, err)
+	}
+	_, err = Rewrite("---\ntitle: hi\n---\n<h1>x</h1>", "c-mine", nil)
+	if err == nil || err.Error() != `line 2: front matter: unknown key "title"` {
+		t.Errorf("** Rewrite of a component with an unknown key error = %v", err)
+	}
+}
+
+func TestRewriteTrackCalls(t *testing.T) {
+	comps := map[string]*ComponentDef{
+		"c-test": {RenderMethod: RenderMethodTemplate},
+		"c-foo":  {RenderMethod: RenderMethodFunc, FuncName: "render_foo"},
+		"c-bar":  {RenderMethod: RenderMethodFuncThenTemplate, FuncName: "prep_bar"},
+	}
+	input := "<c-test a=\"1\" />\n<c-foo />\n<c-bar b={{.}} /><c-slot-body />"
+	exp := `{{template "c-test" ($.Call "c-test" "page.html:1" nil "a" "1")}}` + "\n" +
+		`{{render_foo ($.Call "c-foo" "page.html:2" nil)}}` + "\n" +
+		`{{template "c-bar" ($.Call "c-bar" "page.html:3" (prep_bar ($.Call "c-bar" "page.html:3" nil "b" (.))) "callerData" .)}}` +
+		`{{write_eval $.Args.bodyTemplate ($.Bind (or $.Args.callerData $.Data))}}`
+	res, err := rewriteTemplate(input, "mypage", comps, rewriteOptions{trackCalls: true, file: "page.html"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := res.code; actual != exp {
+		t.Errorf("** rewriteTemplate(%s) returned:\n\t%s\nexpected:\n\t%s", input, actual, exp)
+	}
+}
+
+func TestBodyTemplateNames(t *testing.T) {
+	comps := map[string]*ComponentDef{
+		"c-box":  {RenderMethod: RenderMethodTemplate, HasSlots: true},
+		"c-test": {RenderMethod: RenderMethodTemplate},
+	}
+	defineRe := regexp.MustCompile(`\{\{define "([^"]+)"`)
+	names := func(input string, trackCalls bool) []string {
+		res, err := rewriteTemplate(input, "mypage", comps, rewriteOptions{trackCalls: trackCalls})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, m := range defineRe.FindAllStringSubmatch(res.code, -1) {
+			names = append(names, m[1])
+		}
+		return names
+	}
+
+	a := names(`<c-box>A</c-box>`, false)
+	b := names(`<c-test/><c-box>B</c-box><c-box>A</c-box>`, false)
+	if len(a) != 1 || len(b) != 2 || b[1] != a[0] {
+		t.Errorf("** body names changed when adding components: %v vs %v", a, b)
+	}
+	if n := names(`<c-box>A</c-box><c-box>A</c-box>`, false); len(n) != 1 {
+		t.Errorf("** identical bodies not shared: %v", n)
+	}
+	for _, name := range names(`<c-box><c-test>B</c-test></c-box>`, false) {
+		if !strings.HasPrefix(name, "mypage___c-") || strings.Count(name, "__body__") != 1 {
+			t.Errorf("** unexpected nested body name %s", name)
+		}
+	}
+	n := names("<c-box><c-test/></c-box>\n<c-box><c-test/></c-box>", true)
+	if len(n) != 2 || n[0] == n[1] {
+		t.Errorf("** bodies at different lines should get distinct names: %v", n)
+	}
+	// suffixes come from positions, not from the order of the bodies
+	if m := names("<c-box><c-test/></c-box>\n<c-box><c-test/></c-box>\n<c-box><c-test/></c-box>", true); len(m) != 3 || m[0] != n[0] || m[1] != n[1] {
+		t.Errorf("** adding an identical body renamed others: %v vs %v", n, m)
+	}
+	if m := names("<c-test/><c-box><c-test/></c-box>\n<c-box><c-test/></c-box>", true); len(m) != 2 || m[0] != n[0] || m[1] != n[1] {
+		t.Errorf("** adding a component renamed bodies: %v vs %v", n, m)
+	}
+}
+
 func must[T any](v T, err error) T {
 	if err != nil {
 		panic(err)
@@ -164,27 +471,64 @@ func must[T any](v T, err error) T {
 	return v
 }
 
-type renderData struct {
-	Data any
-	Args map[string]any
-}
-
-func (d *renderData) Bind(value any, args ...any) *renderData {
-	n := len(args)
-	if n%2 != 0 {
-		panic(fmt.Errorf("odd number of arguments %d: %v", n, args))
-	}
-	m := make(map[string]any, n/2)
-	for i := 0; i < n; i += 2 {
-		key, value := args[i], args[i+1]
-		if keyStr, ok := key.(string); ok {
-			m[keyStr] = value
-		} else {
-			panic(fmt.Errorf("argument %d must be a string, got %T: %v", i, key, key))
+func benchmarkRewrite(b *testing.B, templ string, comps map[string]*ComponentDef) {
+	b.SetBytes(int64(len(templ)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := rewriteTemplate(templ, "page", comps, rewriteOptions{trackCalls: true}); err != nil {
+			b.Fatal(err)
 		}
 	}
-	return &renderData{
-		Data: value,
-		Args: m,
+}
+
+func BenchmarkRewrite(b *testing.B) {
+	comps := map[string]*ComponentDef{
+		"c-button": {RenderMethod: RenderMethodTemplate},
+		"c-box":    {RenderMethod: RenderMethodTemplate, HasSlots: true},
+		"c-icon":   {RenderMethod: RenderMethodFunc, FuncName: "c_icon"},
 	}
+
+	b.Run("big page", func(b *testing.B) {
+		var buf strings.Builder
+		for i := 0; i < 2000; i++ {
+			fmt.Fprintf(&buf, "<tr>\n  <td>{{.Name}}</td>\n  <td><c-icon name=\"star\" /> <c-button kind=primary>Edit {{.Name}}</c-button></td>\n")
+			fmt.Fprintf(&buf, "  <td><c-box title=\"row\"><c-button>{{if .Ok}}ok{{end}}</c-button></c-box></td>\n</tr>\n")
+		}
+		benchmarkRewrite(b, buf.String(), comps)
+	})
+
+	b.Run("many attributes", func(b *testing.B) {
+		var buf strings.Builder
+		for i := 0; i < 500; i++ {
+			buf.WriteString("<c-button")
+			for j := 0; j < 20; j++ {
+				fmt.Fprintf(&buf, " a%d=\"v{{.X}}\" b%d='w' c%d={{.Y}} d%d=naked e%d", j, j, j, j, j)
+			}
+			buf.WriteString(" />\n")
+		}
+		benchmarkRewrite(b, buf.String(), comps)
+	})
+
+	b.Run("many errors", func(b *testing.B) {
+		templ := strings.Repeat("<p>text</p>\n<c-unknown a=1 />\n", 5000)
+		b.SetBytes(int64(len(templ)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := rewriteTemplate(templ, "page", comps, rewriteOptions{}); err == nil {
+				b.Fatal("expected an error")
+			}
+		}
+	})
+
+	b.Run("deep nesting", func(b *testing.B) {
+		deep := make(map[string]*ComponentDef)
+		var open, close strings.Builder
+		for i := 0; i < 50; i++ {
+			name := fmt.Sprintf("c-n%d", i)
+			deep[name] = &ComponentDef{RenderMethod: RenderMethodTemplate, HasSlots: i%2 == 0}
+			fmt.Fprintf(&open, "<%s x=\"%d\">\n<p>{{.}}</p>\n", name, i)
+			fmt.Fprintf(&close, "</c-n%d>\n", 49-i)
+		}
+		benchmarkRewrite(b, open.String()+close.String(), deep)
+	})
 }
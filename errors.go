@@ -0,0 +1,99 @@
+package minicomponents
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ComponentError is returned by the Registry render methods when rendering
+// fails inside a component. It carries the component stack at the point of
+// failure.
+type ComponentError struct {
+	Err error
+	// Stack lists the components being rendered, innermost first.
+	Stack []StackFrame
+
+	msg string
+}
+
+type StackFrame struct {
+	Component string
+	// Pos is the file:line of the component tag, empty for components
+	// rendered from Go code.
+	Pos string
+	// Body is set when the frame is the body passed to the component
+	// rather than the component itself.
+	Body bool
+}
+
+func (f StackFrame) String() string {
+	s := "<" + f.Component + ">"
+	if f.Body {
+		s = "body of " + s
+	}
+	if f.Pos != "" {
+		s += " at " + f.Pos
+	}
+	return s
+}
+
+func (e *ComponentError) Error() string {
+	var buf strings.Builder
+	buf.WriteString(e.msg)
+	for _, f := range e.Stack {
+		buf.WriteString("\n\tin ")
+		buf.WriteString(f.String())
+	}
+	return buf.String()
+}
+
+func (e *ComponentError) Unwrap() error {
+	return e.Err
+}
+
+// stackError records the component stack where an error occurred. It is
+// transparent, the stack is only printed once the error surfaces as a
+// ComponentError.
+type stackError struct {
+	err   error
+	frame *callFrame
+}
+
+func (e *stackError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stackError) Unwrap() error {
+	return e.err
+}
+
+// withStack attaches the stack to err unless the error comes from deeper
+// down and already has one.
+func withStack(err error, frame *callFrame) error {
+	var se *stackError
+	if frame == nil || errors.As(err, &se) {
+		return err
+	}
+	return &stackError{err: err, frame: frame}
+}
+
+// componentError turns an error with a recorded stack into a ComponentError,
+// replacing generated body template names in its message.
+func componentError(err error) error {
+	var se *stackError
+	if err == nil || !errors.As(err, &se) {
+		return err
+	}
+	ce := &ComponentError{Err: err}
+	var replacements []string
+	for f := se.frame; f != nil; f = f.parent {
+		sf := StackFrame{Component: f.comp, Pos: f.pos, Body: f.body != ""}
+		ce.Stack = append(ce.Stack, sf)
+		if sf.Body {
+			replacements = append(replacements, f.body, fmt.Sprintf("[%v]", sf))
+		}
+	}
+	ce.msg = strings.NewReplacer(replacements...).Replace(err.Error())
+	return ce
+}
@@ -0,0 +1,247 @@
+package minicomponents
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const frontMatterDelim = "---"
+
+type Prop struct {
+	Name     string
+	Required bool
+}
+
+func findProp(props []Prop, name string) int {
+	for i, prop := range props {
+		if prop.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// cutFrontMatter splits off a leading ---delimited metadata block. lines is
+// the number of source lines occupied by the block, including delimiters.
+func cutFrontMatter(code string) (meta, body string, lines int, found bool) {
+	first, rest, ok := cutLine(code)
+	if !ok || strings.TrimSpace(first) != frontMatterDelim {
+		return "", code, 0, false
+	}
+	start := len(code) - len(rest)
+	lines = 1
+	for rest != "" {
+		var line string
+		lineStart := len(code) - len(rest)
+		line, rest, _ = cutLine(rest)
+		lines++
+		if strings.TrimSpace(line) == frontMatterDelim {
+			return code[start:lineStart], rest, lines, true
+		}
+	}
+	return "", code, 0, false
+}
+
+func cutLine(s string) (line, rest string, found bool) {
+	line, rest, found = strings.Cut(s, "\n")
+	return strings.TrimSuffix(line, "\r"), rest, found
+}
+
+func StripFrontMatter(code string) string {
+	_, body, _, _ := cutFrontMatter(code)
+	return body
+}
+
+// frontMatterValue is a key of a front matter block with its values and
+// the source line of the key.
+type frontMatterValue struct {
+	key  string
+	list []string
+	line int
+}
+
+func parseFrontMatter(meta string, def *ComponentDef) error {
+	var values []frontMatterValue
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(meta), "{") {
+		values, err = parseJSONFrontMatter(meta)
+	} else {
+		values, err = parseLineFrontMatter(meta)
+	}
+	if err != nil {
+		return err
+	}
+
+	var required []string
+	hasProps := false
+	for _, v := range values {
+		key, list := v.key, v.list
+		switch key {
+		case "props":
+			hasProps = true
+			for _, name := range list {
+				if findProp(def.Props, name) < 0 {
+					def.Props = append(def.Props, Prop{Name: name})
+				}
+			}
+		case "required":
+			required = list
+		case "slots":
+			def.Slots = list
+		case "func":
+			if def.FuncName, err = single(v); err != nil {
+				return err
+			}
+		case "template":
+			if def.TemplateName, err = single(v); err != nil {
+				return err
+			}
+		case "render":
+			s, err := single(v)
+			if err != nil {
+				return err
+			}
+			if def.RenderMethod = renderMethodsByName[s]; def.RenderMethod == RenderMethodNone {
+				return &ParseErr{Line: v.line, Msg: fmt.Sprintf("front matter: unknown render method %q", s)}
+			}
+		default:
+			return &ParseErr{Line: v.line, Msg: fmt.Sprintf("front matter: unknown key %q", key)}
+		}
+	}
+	for _, name := range required {
+		if i := findProp(def.Props, name); i >= 0 {
+			def.Props[i].Required = true
+		} else {
+			def.Props = append(def.Props, Prop{Name: name, Required: true})
+		}
+	}
+	if def.Props == nil && hasProps {
+		def.Props = []Prop{}
+	}
+	return nil
+}
+
+var renderMethodsByName = map[string]RenderMethod{
+	"template":           RenderMethodTemplate,
+	"func":               RenderMethodFunc,
+	"func-then-template": RenderMethodFuncThenTemplate,
+}
+
+func single(v frontMatterValue) (string, error) {
+	if len(v.list) != 1 {
+		return "", &ParseErr{Line: v.line, Msg: fmt.Sprintf("front matter: %s must have a single value", v.key)}
+	}
+	return v.list[0], nil
+}
+
+// frontMatterLine is the source line of the first line of a front matter
+// block; the opening delimiter is line 1.
+const frontMatterLine = 2
+
+func parseLineFrontMatter(meta string) ([]frontMatterValue, error) {
+	var values []frontMatterValue
+	seen := make(map[string]bool)
+	inList := false
+	for i, line := range strings.Split(meta, "\n") {
+		lineNo := frontMatterLine + i
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if item, ok := strings.CutPrefix(line, "- "); ok {
+			if !inList {
+				return nil, &ParseErr{Line: lineNo, Msg: "front matter: list item outside of a list"}
+			}
+			last := &values[len(values)-1]
+			last.list = append(last.list, unquote(strings.TrimSpace(item)))
+			continue
+		}
+
+		i := strings.IndexAny(line, ":=")
+		if i < 0 {
+			return nil, &ParseErr{Line: lineNo, Msg: fmt.Sprintf("front matter: expected key: value, got %q", line)}
+		}
+		key, value := unquote(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:])
+		if seen[key] {
+			return nil, &ParseErr{Line: lineNo, Msg: fmt.Sprintf("front matter: duplicate key %q", key)}
+		}
+		seen[key] = true
+		if value == "" {
+			inList = true
+			values = append(values, frontMatterValue{key: key, list: []string{}, line: lineNo})
+			continue
+		}
+		inList = false
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = unquote(strings.TrimSpace(item)); item != "" {
+				list = append(list, item)
+			}
+		}
+		values = append(values, frontMatterValue{key: key, list: list, line: lineNo})
+	}
+	return values, nil
+}
+
+func parseJSONFrontMatter(meta string) ([]frontMatterValue, error) {
+	lineAt := func(offset int64) int {
+		return frontMatterLine + strings.Count(meta[:offset], "\n")
+	}
+	dec := json.NewDecoder(strings.NewReader(meta))
+	fail := func(err error) error {
+		line := lineAt(dec.InputOffset())
+		if serr, ok := err.(*json.SyntaxError); ok {
+			line = lineAt(serr.Offset)
+		}
+		return &ParseErr{Line: line, Msg: fmt.Sprintf("front matter: %v", err)}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, fail(err)
+	}
+	var values []frontMatterValue
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fail(err)
+		}
+		key, line := tok.(string), lineAt(dec.InputOffset())
+		if seen[key] {
+			return nil, &ParseErr{Line: line, Msg: fmt.Sprintf("front matter: duplicate key %q", key)}
+		}
+		seen[key] = true
+		var raw any
+		if err := dec.Decode(&raw); err != nil {
+			return nil, fail(err)
+		}
+		switch raw := raw.(type) {
+		case string:
+			values = append(values, frontMatterValue{key: key, list: []string{raw}, line: line})
+		case []any:
+			list := make([]string, 0, len(raw))
+			for _, item := range raw {
+				s, ok := item.(string)
+				if !ok {
+					return nil, &ParseErr{Line: line, Msg: fmt.Sprintf("front matter: %s must be a list of strings", key)}
+				}
+				list = append(list, s)
+			}
+			values = append(values, frontMatterValue{key: key, list: list, line: line})
+		default:
+			return nil, &ParseErr{Line: line, Msg: fmt.Sprintf("front matter: %s must be a string or a list of strings", key)}
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, fail(err)
+	}
+	return values, nil
+}
+
+func unquote(s string) string {
+	if n := len(s); n >= 2 && (s[0] == '"' || s[0] == '\'') && s[n-1] == s[0] {
+		return s[1 : n-1]
+	}
+	return s
+}
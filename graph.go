@@ -0,0 +1,176 @@
+package minicomponents
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+type DependencyGraph struct {
+	Nodes []string         `json:"nodes"`
+	Edges []DependencyEdge `json:"edges"`
+}
+
+// DependencyEdge says that template From uses component To. Guarded edges
+// only come from tags nested in if, range or with actions.
+type DependencyEdge struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Guarded bool   `json:"guarded,omitempty"`
+}
+
+func dedupUses(uses []componentUse) []componentUse {
+	var result []componentUse
+	index := make(map[string]int)
+	for _, use := range uses {
+		if i, ok := index[use.Name]; ok {
+			result[i].Guarded = result[i].Guarded && use.Guarded
+		} else {
+			index[use.Name] = len(result)
+			result = append(result, use)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Dependencies returns the components used directly by the given template,
+// including in slot bodies.
+func (r *Registry) Dependencies(name string) []string {
+	cs := r.state.Load()
+	if cs == nil {
+		return nil
+	}
+	var result []string
+	for _, use := range cs.deps[name] {
+		result = append(result, use.Name)
+	}
+	return result
+}
+
+// Dependents returns the templates that use the given component directly.
+func (r *Registry) Dependents(name string) []string {
+	cs := r.state.Load()
+	if cs == nil {
+		return nil
+	}
+	var result []string
+	for _, from := range sortedKeys(cs.deps) {
+		for _, use := range cs.deps[from] {
+			if use.Name == name {
+				result = append(result, from)
+			}
+		}
+	}
+	return result
+}
+
+// AllDependents returns the templates that use the given component directly
+// or via other components, i.e. everything that a change to it can break.
+func (r *Registry) AllDependents(name string) []string {
+	seen := map[string]bool{name: true}
+	queue := []string{name}
+	var result []string
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, dep := range r.Dependents(cur) {
+			if !seen[dep] {
+				seen[dep] = true
+				result = append(result, dep)
+				queue = append(queue, dep)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (r *Registry) Graph() *DependencyGraph {
+	g := &DependencyGraph{Nodes: []string{}, Edges: []DependencyEdge{}}
+	cs := r.state.Load()
+	if cs == nil {
+		return g
+	}
+	nodes := make(map[string]bool)
+	for name := range cs.defs {
+		nodes[name] = true
+	}
+	for _, from := range sortedKeys(cs.deps) {
+		nodes[from] = true
+		for _, use := range cs.deps[from] {
+			g.Edges = append(g.Edges, DependencyEdge{From: from, To: use.Name, Guarded: use.Guarded})
+		}
+	}
+	g.Nodes = sortedKeys(nodes)
+	return g
+}
+
+func (g *DependencyGraph) WriteDOT(w io.Writer) error {
+	if _, err := io.WriteString(w, "digraph components {\n"); err != nil {
+		return err
+	}
+	for _, node := range g.Nodes {
+		if _, err := fmt.Fprintf(w, "\t%s;\n", strconv.Quote(node)); err != nil {
+			return err
+		}
+	}
+	for _, e := range g.Edges {
+		var attrs string
+		if e.Guarded {
+			attrs = " [style=dashed]"
+		}
+		if _, err := fmt.Fprintf(w, "\t%s -> %s%s;\n", strconv.Quote(e.From), strconv.Quote(e.To), attrs); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
+
+// findUnguardedCycle returns a path of templates that include each other
+// unconditionally, ending with the first one again, or nil.
+func findUnguardedCycle(deps map[string][]componentUse) []string {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case inProgress:
+			for i, n := range stack {
+				if n == name {
+					return append(append([]string(nil), stack[i:]...), name)
+				}
+			}
+		case done:
+			return nil
+		}
+		state[name] = inProgress
+		stack = append(stack, name)
+		for _, use := range deps[name] {
+			if use.Guarded {
+				continue
+			}
+			if cycle := visit(use.Name); cycle != nil {
+				return cycle
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+		return nil
+	}
+	for _, name := range sortedKeys(deps) {
+		if cycle := visit(name); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
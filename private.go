@@ -0,0 +1,79 @@
+package minicomponents
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"regexp"
+	"sort"
+	"text/template/parse"
+)
+
+// Templates defined as {{define "@@__name"}} in a file are named
+// file__name and are private to that file, as are the templates of
+// <c-define> and of bodies. The rewriter reports the private names it
+// produces, and owner funcs map them back to their files.
+
+var defineRe = regexp.MustCompile(`\{\{-?\s*(?:define|block)\s+"([^"]+)"`)
+
+// checkPrivateDefines reports templates in the rewritten code of a file that
+// take a name private to another file.
+func checkPrivateDefines(file, code string, ownerOf func(string) string) error {
+	var errs []error
+	for _, m := range defineRe.FindAllStringSubmatch(code, -1) {
+		if owner := ownerOf(m[1]); owner != "" && owner != file {
+			errs = append(errs, fmt.Errorf("%s: defines template %s, which is private to %s", file, m[1], owner))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkPrivateCalls reports calls to templates private to another file and
+// to undefined private templates, looking at the templates parsed from the
+// files accepted by parsedFrom.
+func checkPrivateCalls(t *template.Template, parsedFrom func(string) bool, ownerOf func(string) string) error {
+	templates := t.Templates()
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name() < templates[j].Name() })
+	var errs []error
+	for _, tmpl := range templates {
+		if tmpl.Tree == nil || tmpl.Tree.Root == nil || !parsedFrom(tmpl.Tree.ParseName) {
+			continue
+		}
+		file := tmpl.Tree.ParseName
+		walkNodes(tmpl.Tree.Root, func(node parse.Node) {
+			n, ok := node.(*parse.TemplateNode)
+			if !ok {
+				return
+			}
+			if owner := ownerOf(n.Name); owner != "" && owner != file {
+				errs = append(errs, fmt.Errorf("%s: calls template %s, which is private to %s", file, n.Name, owner))
+			} else if owner != "" && t.Lookup(n.Name) == nil {
+				errs = append(errs, fmt.Errorf("%s: calls undefined template %s", file, n.Name))
+			}
+		})
+	}
+	return errors.Join(errs...)
+}
+
+// walkNodes calls fn for each node of a parse tree.
+func walkNodes(node parse.Node, fn func(parse.Node)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			for _, child := range n.Nodes {
+				walkNodes(child, fn)
+			}
+		}
+		return
+	case *parse.IfNode:
+		walkNodes(n.List, fn)
+		walkNodes(n.ElseList, fn)
+	case *parse.RangeNode:
+		walkNodes(n.List, fn)
+		walkNodes(n.ElseList, fn)
+	case *parse.WithNode:
+		walkNodes(n.List, fn)
+		walkNodes(n.ElseList, fn)
+	}
+	fn(node)
+}
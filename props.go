@@ -0,0 +1,312 @@
+package minicomponents
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	renderDataType = reflect.TypeOf((*RenderData)(nil))
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+	htmlType       = reflect.TypeOf(template.HTML(""))
+	stringType     = reflect.TypeOf("")
+	bodyType       = reflect.TypeOf((*Body)(nil))
+)
+
+// goFunc adapts a Go component func to the func(*RenderData) (any, error)
+// calling convention used by the rewritten templates.
+type goFunc struct {
+	call      func(rd *RenderData) (any, error)
+	propsType reflect.Type
+	props     []Prop
+}
+
+type propField struct {
+	Prop
+	index []int
+}
+
+func newGoFunc(compName string, fn any, isRender bool) (*goFunc, error) {
+	switch fn := fn.(type) {
+	case func(*RenderData) (any, error):
+		if isRender {
+			return &goFunc{call: withRenderedBodies(func(rd *RenderData) (any, error) {
+				v, err := fn(rd)
+				if err != nil {
+					return nil, err
+				}
+				return renderValue(v)
+			})}, nil
+		}
+		return &goFunc{call: withRenderedBodies(fn)}, nil
+	case func(*RenderData) template.HTML:
+		return &goFunc{call: withRenderedBodies(func(rd *RenderData) (any, error) {
+			return fn(rd), nil
+		})}, nil
+	case func(*RenderData) (template.HTML, error):
+		return &goFunc{call: withRenderedBodies(func(rd *RenderData) (any, error) {
+			return fn(rd)
+		})}, nil
+	}
+
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func {
+		return nil, fmt.Errorf("expected a func, got %T", fn)
+	}
+
+	rdIndex, propsIndex := -1, -1
+	var propsType reflect.Type
+	var fields []propField
+	for i := 0; i < ft.NumIn(); i++ {
+		in := ft.In(i)
+		if in == renderDataType && rdIndex < 0 {
+			rdIndex = i
+		} else if structType(in) != nil && propsIndex < 0 {
+			propsIndex, propsType = i, in
+			var err error
+			fields, err = propFields(structType(in))
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, fmt.Errorf("unsupported argument %d of type %v, expected *RenderData or a props struct", i, in)
+		}
+	}
+
+	nout := ft.NumOut()
+	if nout < 1 || nout > 2 || (nout == 2 && ft.Out(1) != errorType) {
+		return nil, fmt.Errorf("must return a value and optionally an error, got %v", ft)
+	}
+	if isRender && ft.Out(0) != htmlType && ft.Out(0) != stringType && ft.Out(0).Kind() != reflect.Interface {
+		return nil, fmt.Errorf("must return template.HTML, string or any, got %v", ft.Out(0))
+	}
+	asHTML := isRender && ft.Out(0).Kind() == reflect.Interface
+
+	g := &goFunc{propsType: propsType}
+	for _, f := range fields {
+		g.props = append(g.props, f.Prop)
+	}
+	g.call = func(rd *RenderData) (any, error) {
+		in := make([]reflect.Value, ft.NumIn())
+		if rdIndex >= 0 {
+			rd, err := rd.withRenderedBodies()
+			if err != nil {
+				return nil, err
+			}
+			in[rdIndex] = reflect.ValueOf(rd)
+		}
+		if propsIndex >= 0 {
+			pv, err := decodeProps(rd.Args, propsType, fields)
+			if err != nil {
+				return nil, fmt.Errorf("<%s>: %w", compName, err)
+			}
+			in[propsIndex] = pv
+		}
+		out := fv.Call(in)
+		if nout == 2 && !out[1].IsNil() {
+			return nil, out[1].Interface().(error)
+		}
+		if asHTML {
+			return renderValue(out[0].Interface())
+		}
+		return out[0].Interface(), nil
+	}
+	return g, nil
+}
+
+// withRenderedBodies wraps a func that reads RenderData.Args itself, which
+// gets bodies as template.HTML rather than *Body.
+func withRenderedBodies(fn func(*RenderData) (any, error)) func(*RenderData) (any, error) {
+	return func(rd *RenderData) (any, error) {
+		rd, err := rd.withRenderedBodies()
+		if err != nil {
+			return nil, err
+		}
+		return fn(rd)
+	}
+}
+
+// tracked calls the func, attaching the component stack to its errors.
+func (g *goFunc) tracked(rd *RenderData) (any, error) {
+	v, err := g.call(rd)
+	if err != nil {
+		return nil, withStack(err, rd.frame)
+	}
+	return v, nil
+}
+
+func structType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Struct {
+		return t
+	}
+	return nil
+}
+
+func propFields(st reflect.Type) ([]propField, error) {
+	var fields []propField
+	for i := 0; i < st.NumField(); i++ {
+		sf := st.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag, hasTag := sf.Tag.Lookup("mc")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = kebabCase(sf.Name)
+		}
+		f := propField{Prop: Prop{Name: name}, index: sf.Index}
+		if hasTag && opts != "" {
+			for _, opt := range strings.Split(opts, ",") {
+				switch opt {
+				case "required":
+					f.Required = true
+				default:
+					return nil, fmt.Errorf("%v.%s: unknown mc tag option %q", st, sf.Name, opt)
+				}
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func kebabCase(s string) string {
+	var buf strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				buf.WriteByte('-')
+			}
+			buf.WriteRune(unicode.ToLower(r))
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+func decodeProps(args map[string]any, typ reflect.Type, fields []propField) (reflect.Value, error) {
+	st := structType(typ)
+	sv := reflect.New(st).Elem()
+	for _, f := range fields {
+		v, ok := args[f.Name]
+		if !ok {
+			if f.Required {
+				return reflect.Value{}, fmt.Errorf("missing required prop %s", f.Name)
+			}
+			continue
+		}
+		if err := assignProp(sv.FieldByIndex(f.index), v); err != nil {
+			return reflect.Value{}, fmt.Errorf("prop %s: %w", f.Name, err)
+		}
+	}
+	if typ.Kind() == reflect.Pointer {
+		return sv.Addr(), nil
+	}
+	return sv, nil
+}
+
+func assignProp(dst reflect.Value, v any) error {
+	if v == nil {
+		return nil
+	}
+	if b, ok := v.(*Body); ok && (dst.Type() == htmlType || dst.Kind() == reflect.String) {
+		h, err := b.HTML()
+		if err != nil {
+			return err
+		}
+		v = h
+	}
+	if h, ok := v.(template.HTML); ok && dst.Type() == bodyType {
+		v = &Body{render: func(w io.Writer) error {
+			_, err := io.WriteString(w, string(h))
+			return err
+		}}
+	}
+	src := reflect.ValueOf(v)
+	dt := dst.Type()
+	if dt == htmlType && src.Kind() == reflect.String && src.Type() != htmlType {
+		dst.SetString(template.HTMLEscapeString(src.String()))
+		return nil
+	}
+	if src.Type().AssignableTo(dt) {
+		dst.Set(src)
+		return nil
+	}
+
+	switch dk, sk := dt.Kind(), src.Kind(); {
+	case dk == reflect.String:
+		if sk == reflect.String {
+			dst.SetString(src.String())
+			return nil
+		}
+		if isNumberKind(sk) || sk == reflect.Bool {
+			dst.SetString(fmt.Sprint(v))
+			return nil
+		}
+	case dk == reflect.Bool:
+		if sk == reflect.String {
+			b, err := strconv.ParseBool(src.String())
+			if err != nil {
+				return fmt.Errorf("cannot convert %q to bool", src.String())
+			}
+			dst.SetBool(b)
+			return nil
+		}
+	case isNumberKind(dk):
+		if sk == reflect.String {
+			return parseNumber(dst, src.String())
+		}
+		if isNumberKind(sk) {
+			return parseNumber(dst, fmt.Sprint(v))
+		}
+	default:
+		if src.Type().ConvertibleTo(dt) && dk == sk {
+			dst.Set(src.Convert(dt))
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot convert %T to %v", v, dt)
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+func parseNumber(dst reflect.Value, s string) error {
+	bits := dst.Type().Bits()
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, bits)
+		if err != nil {
+			return fmt.Errorf("cannot convert %q to %v", s, dst.Type())
+		}
+		dst.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, bits)
+		if err != nil {
+			return fmt.Errorf("cannot convert %q to %v", s, dst.Type())
+		}
+		dst.SetUint(n)
+	default:
+		n, err := strconv.ParseFloat(s, bits)
+		if err != nil {
+			return fmt.Errorf("cannot convert %q to %v", s, dst.Type())
+		}
+		dst.SetFloat(n)
+	}
+	return nil
+}
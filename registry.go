@@ -0,0 +1,585 @@
+package minicomponents
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template/parse"
+)
+
+type Registry struct {
+	mu            sync.Mutex
+	funcs         template.FuncMap
+	sources       map[string]string
+	files         map[string]string
+	prepare       map[string]*goFunc
+	render        map[string]*goFunc
+	dirs          []*sourceDir
+	snippetLimits SnippetLimits
+	maxDepth      int
+
+	cacheDir string
+	bundle   map[string]*cacheEntry
+
+	rewritten     map[string]*rewrittenTemplate
+	rewrittenDefs map[string]*ComponentDef
+	lastErr       error
+	onError       func(error)
+
+	state atomic.Pointer[compiledSet]
+}
+
+// compiledSet is an immutable result of Compile, swapped atomically so that
+// renders in flight keep using the set they started with.
+type compiledSet struct {
+	tmpl *template.Template
+	base *template.Template
+	defs map[string]*ComponentDef
+	fmap template.FuncMap
+	deps map[string][]componentUse
+
+	bodies map[string]bodyInfo
+	// private maps private templates, bodies included, to their files.
+	private  map[string]string
+	styles   map[string]string
+	scripts  map[string][]string
+	maxDepth int
+
+	limits        SnippetLimits
+	snippetsMu    sync.Mutex
+	snippets      map[string]*list.Element
+	snippetLRU    *list.List
+	snippetBodies map[string]bodyInfo
+}
+
+type rewrittenTemplate struct {
+	source  string
+	file    string
+	key     string
+	code    string
+	uses    []componentUse
+	bodies  map[string]bodyInfo
+	private []string
+	defines []string
+	styles  string
+	scripts []string
+}
+
+func (rt *rewrittenTemplate) entry() *cacheEntry {
+	return &cacheEntry{Key: rt.key, Code: rt.code, Uses: rt.uses, Bodies: rt.bodies, Private: rt.private, Defines: rt.defines, Styles: rt.styles, Scripts: rt.scripts}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		funcs:   make(template.FuncMap),
+		sources: make(map[string]string),
+		files:   make(map[string]string),
+		prepare: make(map[string]*goFunc),
+		render:  make(map[string]*goFunc),
+
+		snippetLimits: DefaultSnippetLimits,
+		maxDepth:      DefaultMaxDepth,
+	}
+}
+
+func (r *Registry) Funcs(funcs template.FuncMap) *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, v := range funcs {
+		r.funcs[k] = v
+	}
+	return r
+}
+
+const DefaultMaxDepth = 100
+
+// SetMaxDepth limits how deeply components can nest at runtime, starting
+// with the next Compile, so that runaway recursion fails with an error
+// instead of exhausting the stack. Zero disables the limit.
+func (r *Registry) SetMaxDepth(depth int) *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxDepth = depth
+	return r
+}
+
+func (r *Registry) AddTemplate(name, code string) *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sources[name] = code
+	return r
+}
+
+// Prepare registers a func that computes the data of a template component.
+// fn accepts *RenderData and/or a props struct, and returns the data value
+// and optionally an error.
+func (r *Registry) Prepare(name string, fn any) *Registry {
+	g, err := newGoFunc(name, fn, false)
+	if err != nil {
+		panic(fmt.Errorf("Prepare(%q): %w", name, err))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prepare[name] = g
+	return r
+}
+
+// Render registers a func that renders a component entirely in Go. fn accepts
+// *RenderData and/or a props struct, and returns template.HTML, string or
+// any and optionally an error. Values other than template.HTML print
+// escaped, like in a template, and nil prints nothing.
+func (r *Registry) Render(name string, fn any) *Registry {
+	g, err := newGoFunc(name, fn, true)
+	if err != nil {
+		panic(fmt.Errorf("Render(%q): %w", name, err))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.render[name] = g
+	return r
+}
+
+func isComponentName(name string) bool {
+	return strings.HasPrefix(name, "c-")
+}
+
+func funcIdent(compName string) string {
+	return strings.ReplaceAll(compName, "-", "_")
+}
+
+func prepareFuncName(compName string) string {
+	return "prepare_" + funcIdent(compName)
+}
+
+// Components resolves the render method of every component from its template
+// file and registered Go funcs.
+func (r *Registry) Components() (map[string]*ComponentDef, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.components()
+}
+
+func (r *Registry) components() (map[string]*ComponentDef, error) {
+	var errs []error
+	names := make(map[string]bool)
+	for name := range r.sources {
+		if isComponentName(name) {
+			names[name] = true
+		}
+	}
+	for name := range r.prepare {
+		names[name] = true
+	}
+	for name := range r.render {
+		names[name] = true
+	}
+
+	defs := make(map[string]*ComponentDef, len(names))
+	for _, name := range sortedKeys(names) {
+		if !isComponentName(name) {
+			errs = append(errs, fmt.Errorf("%s: component names must start with c-", name))
+			continue
+		}
+		code, hasTmpl := r.sources[name]
+		_, hasPrep := r.prepare[name]
+		_, hasRender := r.render[name]
+
+		if hasRender {
+			if hasTmpl {
+				errs = append(errs, fmt.Errorf("%s: has both a template and a render func", name))
+				continue
+			}
+			if hasPrep {
+				errs = append(errs, fmt.Errorf("%s: has both a prepare func and a render func", name))
+				continue
+			}
+			defs[name] = &ComponentDef{
+				RenderMethod: RenderMethodFunc,
+				FuncName:     funcIdent(name),
+				Props:        r.render[name].props,
+			}
+			continue
+		}
+		if !hasTmpl {
+			errs = append(errs, fmt.Errorf("%s: has a prepare func but no template", name))
+			continue
+		}
+
+		def, err := ScanComponent(code)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		if hasPrep {
+			if def.RenderMethod != RenderMethodTemplate {
+				errs = append(errs, fmt.Errorf("%s: has a prepare func, but front matter already specifies func %s", name, def.FuncName))
+				continue
+			}
+			def.RenderMethod = RenderMethodFuncThenTemplate
+			def.FuncName = prepareFuncName(name)
+			def.Props = mergeProps(def.Props, r.prepare[name].props)
+		}
+		defs[name] = def
+	}
+	return defs, errors.Join(errs...)
+}
+
+func mergeProps(a, b []Prop) []Prop {
+	if a == nil {
+		return b
+	}
+	for _, prop := range b {
+		if i := findProp(a, prop.Name); i >= 0 {
+			a[i].Required = a[i].Required || prop.Required
+		} else {
+			a = append(a, prop)
+		}
+	}
+	return a
+}
+
+// Compile rewrites and parses all templates. On failure, the previously
+// compiled set stays in use.
+func (r *Registry) Compile() error {
+	r.mu.Lock()
+	err := r.compile()
+	r.mu.Unlock()
+	return r.reportErr(err)
+}
+
+func (r *Registry) reportErr(err error) error {
+	r.mu.Lock()
+	r.lastErr = err
+	onError := r.onError
+	r.mu.Unlock()
+	if err != nil && onError != nil {
+		onError(err)
+	}
+	return err
+}
+
+func (r *Registry) compile() error {
+	defs, err := r.components()
+	if err != nil {
+		return err
+	}
+	if r.rewritten == nil {
+		r.rewritten = make(map[string]*rewrittenTemplate)
+	}
+	r.invalidateDependents(defs)
+
+	fmap := r.funcMap()
+	root := template.New("").Funcs(fmap)
+	var errs []error
+	var dh string
+	bodyOwners, privateOwners := make(map[string]string), make(map[string]string)
+	failed := make(map[string]bool)
+	for _, name := range sortedKeys(r.sources) {
+		source, file := r.sources[name], r.files[name]
+		rt := r.rewritten[name]
+		if rt == nil || rt.source != source || rt.file != file {
+			if dh == "" {
+				dh = defsHash(defs)
+			}
+			key := cacheKey(dh, name, file, source)
+			if e := r.cached(key, name); e != nil {
+				rt = &rewrittenTemplate{source: source, file: file, key: key, code: e.Code, uses: e.Uses, bodies: e.Bodies, private: e.Private, defines: e.Defines, styles: e.Styles, scripts: e.Scripts}
+			} else {
+				code, styles, scripts := source, "", []string(nil)
+				if isComponentName(name) {
+					code, scripts = cutScripts(code)
+					code, styles = cutStyles(name, code)
+				}
+				res, err := rewriteTemplate(code, name, defs, rewriteOptions{trackCalls: true, file: file})
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", name, err))
+					failed[name] = true
+					continue
+				}
+				code = res.code
+				if !isComponentName(name) {
+					code = WrapTemplate(code, "{{range data_scope $}}", "{{end}}")
+				}
+				rt = &rewrittenTemplate{source: source, file: file, key: key, code: code, uses: dedupUses(res.uses), bodies: res.bodies, private: res.private, defines: res.defines, styles: styles, scripts: scripts}
+				r.storeCached(rt.entry())
+			}
+			r.rewritten[name] = rt
+		}
+		if err := claimBodies(name, rt.bodies, r.sources, bodyOwners); err != nil {
+			errs = append(errs, err)
+			failed[name] = true
+		}
+		for _, k := range rt.private {
+			if _, dup := privateOwners[k]; !dup {
+				privateOwners[k] = name
+			}
+		}
+	}
+	for k, owner := range bodyOwners {
+		privateOwners[k] = owner
+	}
+	ownerOf := func(name string) string { return privateOwners[name] }
+	for _, name := range sortedKeys(r.sources) {
+		if failed[name] {
+			continue
+		}
+		rt := r.rewritten[name]
+		if err := checkPrivateDefines(name, rt.code, ownerOf); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := root.New(name).Parse(rt.code); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for name := range r.rewritten {
+		if _, ok := r.sources[name]; !ok {
+			delete(r.rewritten, name)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if err := checkPrivateCalls(root, func(string) bool { return true }, ownerOf); err != nil {
+		return err
+	}
+	defines := make(map[string]bool)
+	for _, rt := range r.rewritten {
+		for _, k := range rt.defines {
+			defines[k] = true
+		}
+	}
+	printBodies(root, func(tmpl *template.Template) bool {
+		return isComponentName(tmpl.Tree.ParseName) || defines[tmpl.Name()]
+	})
+	deps := make(map[string][]componentUse, len(r.rewritten))
+	bodies := make(map[string]bodyInfo)
+	styles := make(map[string]string)
+	scripts := make(map[string][]string)
+	for name, rt := range r.rewritten {
+		deps[name] = rt.uses
+		if rt.styles != "" {
+			styles[name] = rt.styles
+		}
+		if len(rt.scripts) > 0 {
+			scripts[name] = rt.scripts
+		}
+		for k, v := range rt.bodies {
+			bodies[k] = v
+		}
+	}
+	if cycle := findUnguardedCycle(deps); cycle != nil {
+		return fmt.Errorf("component includes itself without an if, range or with guard: %s", strings.Join(cycle, " > "))
+	}
+	// html/template refuses to parse into a set after it has been executed,
+	// so keep a pristine copy to clone from when compiling snippets.
+	tmpl, err := root.Clone()
+	if err != nil {
+		return err
+	}
+	r.state.Store(&compiledSet{tmpl: tmpl, base: root, defs: defs, fmap: fmap, deps: deps, bodies: bodies, private: privateOwners, styles: styles, scripts: scripts, maxDepth: r.maxDepth, limits: r.snippetLimits})
+	return nil
+}
+
+// invalidateDependents drops the cached code of templates that use
+// components whose defs have changed, since the code generated for a tag
+// depends on the def.
+func (r *Registry) invalidateDependents(defs map[string]*ComponentDef) {
+	changed := make(map[string]bool)
+	for name, def := range defs {
+		if !reflect.DeepEqual(def, r.rewrittenDefs[name]) {
+			changed[name] = true
+		}
+	}
+	for name := range r.rewrittenDefs {
+		if defs[name] == nil {
+			changed[name] = true
+		}
+	}
+	for name, rt := range r.rewritten {
+		for _, use := range rt.uses {
+			if changed[use.Name] {
+				delete(r.rewritten, name)
+				break
+			}
+		}
+	}
+	r.rewrittenDefs = defs
+}
+
+// LastError returns the error of the most recent Compile or Reload, if it
+// failed.
+func (r *Registry) LastError() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastErr
+}
+
+// OnError sets a func called whenever Compile fails, including recompiles
+// triggered by Watch.
+func (r *Registry) OnError(fn func(error)) *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onError = fn
+	return r
+}
+
+func (r *Registry) current() (*compiledSet, error) {
+	cs := r.state.Load()
+	if cs == nil {
+		return nil, fmt.Errorf("registry is not compiled")
+	}
+	return cs, nil
+}
+
+// printBodies appends print_body to the print actions of the component
+// templates accepted by component, so that a *Body prints as its HTML
+// however a component reaches it, e.g. {{.Data.body}} or
+// {{with .Args.body}}{{.}}{{end}}. Pages only get bodies through
+// components, so their actions are left alone.
+func printBodies(t *template.Template, component func(*template.Template) bool) {
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree == nil || tmpl.Tree.Root == nil || !component(tmpl) {
+			continue
+		}
+		walkNodes(tmpl.Tree.Root, func(node parse.Node) {
+			action, ok := node.(*parse.ActionNode)
+			if !ok || len(action.Pipe.Decl) > 0 || printsHTML(action.Pipe) || escapes(action.Pipe) {
+				return
+			}
+			printBody := parse.NewIdentifier("print_body").SetTree(tmpl.Tree).SetPos(action.Pos)
+			// in {{.Args.body | f}}, f gets the HTML too
+			if first := action.Pipe.Cmds[0]; len(action.Pipe.Cmds) > 1 && len(first.Args) == 1 && isOperand(first.Args[0]) {
+				first.Args = []parse.Node{printBody, first.Args[0]}
+			}
+			cmd := action.Pipe.Cmds[0].Copy().(*parse.CommandNode)
+			cmd.Args = []parse.Node{printBody}
+			action.Pipe.Cmds = append(action.Pipe.Cmds, cmd)
+		})
+	}
+}
+
+// printsHTML reports whether a pipeline ends in one of our funcs that
+// already return template.HTML.
+func printsHTML(pipe *parse.PipeNode) bool {
+	last := pipe.Cmds[len(pipe.Cmds)-1]
+	ident, ok := last.Args[0].(*parse.IdentifierNode)
+	return ok && htmlFuncs[ident.Ident]
+}
+
+// escapes reports whether a pipeline ends in a predefined escaper, which
+// html/template only allows in the last position.
+func escapes(pipe *parse.PipeNode) bool {
+	last := pipe.Cmds[len(pipe.Cmds)-1]
+	ident, ok := last.Args[0].(*parse.IdentifierNode)
+	return ok && (ident.Ident == "html" || ident.Ident == "urlquery")
+}
+
+// isOperand reports whether a node is a value rather than a func call.
+func isOperand(node parse.Node) bool {
+	switch node.(type) {
+	case *parse.FieldNode, *parse.VariableNode, *parse.DotNode, *parse.ChainNode:
+		return true
+	}
+	return false
+}
+
+var htmlFuncs = map[string]bool{
+	"eval": true, "error": true, "concat_html": true, "render": true, "write_eval": true, "write_body": true,
+	"dynamic": true, "write_dynamic": true, "print_body": true,
+}
+
+// claimBodies records the generated body templates of a template in
+// owners, reporting names that a source template or another template's
+// bodies already take, since {{define}} would silently replace them.
+func claimBodies(name string, bodies map[string]bodyInfo, sources map[string]string, owners map[string]string) error {
+	var errs []error
+	for _, k := range sortedKeys(bodies) {
+		if _, dup := sources[k]; dup {
+			errs = append(errs, fmt.Errorf("%s: generated body template name %s collides with a template of that name", name, k))
+		} else if owner, dup := owners[k]; dup && owner != name {
+			errs = append(errs, fmt.Errorf("%s: generated body template name %s collides with a body of %s", name, k, owner))
+		} else {
+			owners[k] = name
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Registry) funcMap() template.FuncMap {
+	funcs := template.FuncMap{
+		"eval":          evalTemplate,
+		"error":         errorFunc,
+		"concat_html":   concatHTML,
+		"lazy_eval":     lazyEval,
+		"render":        renderValue,
+		"write_eval":    writeEval,
+		"write_body":    writeBody,
+		"dynamic":       dynamic,
+		"write_dynamic": writeDynamic,
+		"data_scope":    dataScope,
+		"print_body":    printBody,
+	}
+	for k, v := range r.funcs {
+		funcs[k] = v
+	}
+	for name, g := range r.prepare {
+		funcs[prepareFuncName(name)] = g.tracked
+	}
+	for name, g := range r.render {
+		funcs[funcIdent(name)] = g.tracked
+	}
+	return funcs
+}
+
+func (r *Registry) Template() *template.Template {
+	if cs := r.state.Load(); cs != nil {
+		return cs.tmpl
+	}
+	return nil
+}
+
+func (r *Registry) ExecuteTemplate(w io.Writer, name string, data any) error {
+	cs, err := r.current()
+	if err != nil {
+		return err
+	}
+	return componentError(cs.tmpl.ExecuteTemplate(w, name, cs.newRenderData(cs.tmpl, name, data, w)))
+}
+
+// newRenderData returns the root data for executing the template page of
+// tmpl into w.
+func (cs *compiledSet) newRenderData(tmpl *template.Template, page string, data any, w io.Writer) *RenderData {
+	return &RenderData{
+		Data: data,
+		Args: map[string]any{},
+		ctx:  &renderContext{tmpl: tmpl, set: cs, w: w, page: page, assets: newAssetState()},
+	}
+}
+
+// body looks up the origin of a generated body template.
+func (cs *compiledSet) body(name string) (bodyInfo, bool) {
+	if info, ok := cs.bodies[name]; ok {
+		return info, true
+	}
+	cs.snippetsMu.Lock()
+	defer cs.snippetsMu.Unlock()
+	info, ok := cs.snippetBodies[name]
+	return info, ok
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,1005 @@
+package minicomponents
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRegistry() *Registry {
+	reg := NewRegistry()
+	reg.AddTemplate("c-card", `<card title="{{.Data.title}}">{{.Data.body}}</card>`)
+	reg.Prepare("c-card", func(rd *RenderData) (any, error) {
+		return map[string]any{
+			"title": strings.ToUpper(rd.Args["title"].(string)),
+			"body":  rd.Args["body"],
+		}, nil
+	})
+	reg.Render("c-icon", func(rd *RenderData) template.HTML {
+		return template.HTML(`<i class="icon-` + template.HTMLEscapeString(rd.Args["name"].(string)) + `"></i>`)
+	})
+	reg.AddTemplate("c-box", `<box>{{.Args.body}}</box>`)
+	return reg
+}
+
+func TestRegistryComponents(t *testing.T) {
+	defs, err := newTestRegistry().Components()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := defs["c-card"]; d.RenderMethod != RenderMethodFuncThenTemplate || d.FuncName != "prepare_c_card" {
+		t.Errorf("** c-card = %+v", *d)
+	}
+	if d := defs["c-icon"]; d.RenderMethod != RenderMethodFunc || d.FuncName != "c_icon" {
+		t.Errorf("** c-icon = %+v", *d)
+	}
+	if d := defs["c-box"]; d.RenderMethod != RenderMethodTemplate {
+		t.Errorf("** c-box = %+v", *d)
+	}
+}
+
+func TestRegistryConflicts(t *testing.T) {
+	reg := NewRegistry()
+	reg.AddTemplate("c-a", `A`)
+	reg.Render("c-a", func(rd *RenderData) template.HTML { return "" })
+	reg.Prepare("c-b", func(rd *RenderData) (any, error) { return nil, nil })
+	reg.AddTemplate("c-c", "---\nfunc: prep_c\n---\nC")
+	reg.Prepare("c-c", func(rd *RenderData) (any, error) { return nil, nil })
+	reg.Render("x-d", func(rd *RenderData) template.HTML { return "" })
+
+	_, err := reg.Components()
+	exp := "c-a: has both a template and a render func\n" +
+		"c-b: has a prepare func but no template\n" +
+		"c-c: has a prepare func, but front matter already specifies func prep_c\n" +
+		"x-d: component names must start with c-"
+	if err == nil || err.Error() != exp {
+		t.Errorf("** Components() error:\n%v\nexpected:\n%s", err, exp)
+	}
+}
+
+func TestClaimBodies(t *testing.T) {
+	sources := map[string]string{"a": "", "b": "", "b___c-x__body__1": ""}
+	owners := make(map[string]string)
+	must(0, claimBodies("a", map[string]bodyInfo{"a___c-x__body__1": {}, "shared": {}}, sources, owners))
+	err := claimBodies("b", map[string]bodyInfo{"shared": {}, "b___c-x__body__1": {}}, sources, owners)
+	exp := "b: generated body template name b___c-x__body__1 collides with a template of that name\n" +
+		"b: generated body template name shared collides with a body of a"
+	if err == nil || err.Error() != exp {
+		t.Errorf("** claimBodies error:\n%v\nexpected:\n%s", err, exp)
+	}
+}
+
+func TestRegistryExecute(t *testing.T) {
+	reg := newTestRegistry()
+	reg.AddTemplate("page", `<h1>{{.Title}}</h1><c-card title="hi"><c-icon name="star" /> {{.Title}}</c-card>`)
+	if err := reg.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	err := reg.ExecuteTemplate(&buf, "page", map[string]any{"Title": "<Hello>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `<h1>&lt;Hello&gt;</h1><card title="HI"><i class="icon-star"></i> &lt;Hello&gt;</card>`
+	if a := buf.String(); a != exp {
+		t.Errorf("** got:\n\t%s\nexpected:\n\t%s", a, exp)
+	}
+
+	reg.AddTemplate("plain", `<p>{{.}}</p>`)
+	must(0, reg.Compile())
+	for _, tt := range []struct {
+		data any
+		exp  string
+	}{
+		{nil, "<p></p>"},
+		{0, "<p>0</p>"},
+		{"", "<p></p>"},
+		{false, "<p>false</p>"},
+	} {
+		buf.Reset()
+		must(0, reg.ExecuteTemplate(&buf, "plain", tt.data))
+		if a := buf.String(); a != tt.exp {
+			t.Errorf("** ExecuteTemplate with %#v got %s, expected %s", tt.data, a, tt.exp)
+		}
+	}
+}
+
+type badgeProps struct {
+	Label    string `mc:"label,required"`
+	Count    int
+	Urgent   bool
+	IconName string
+	Body     template.HTML `mc:"body"`
+	internal string
+}
+
+func TestRegistryTypedFuncs(t *testing.T) {
+	reg := NewRegistry()
+	reg.Render("c-badge", func(p badgeProps) template.HTML {
+		return template.HTML(fmt.Sprintf(`<badge count="%d" urgent="%v" icon="%s">%s: %s</badge>`, p.Count, p.Urgent, p.IconName, template.HTMLEscapeString(p.Label), p.Body))
+	})
+	reg.Render("c-count", func(rd *RenderData, p *struct{ N float64 }) (string, error) {
+		return fmt.Sprintf("%v of %v", p.N, rd.Data), nil
+	})
+	reg.Render("c-any", func(rd *RenderData) (any, error) {
+		if rd.Data == nil {
+			return nil, nil
+		}
+		return rd.Data, nil
+	})
+	reg.Render("c-typed-any", func(p struct{ V any }) any {
+		return p.V
+	})
+	reg.AddTemplate("page", `<c-badge label="<hi>" count=3 urgent icon-name={{.Icon}}>a &amp; b</c-badge>|<c-count n={{.N}} data={{.Icon}} />|<c-any data={{.Icon}} /><c-any />|<c-typed-any v="<i>" />`)
+	reg.AddTemplate("bad", `<c-badge label="x" count="three" />`)
+	if err := reg.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	defs, _ := reg.Components()
+	expProps := []Prop{{Name: "label", Required: true}, {Name: "count"}, {Name: "urgent"}, {Name: "icon-name"}, {Name: "body"}}
+	if a, e := fmt.Sprint(defs["c-badge"].Props), fmt.Sprint(expProps); a != e {
+		t.Errorf("** c-badge props = %s, expected %s", a, e)
+	}
+
+	var buf strings.Builder
+	err := reg.ExecuteTemplate(&buf, "page", map[string]any{"Icon": "star", "N": 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `<badge count="3" urgent="true" icon="star">&lt;hi&gt;: a &amp; b</badge>|42 of star|star|&lt;i&gt;`
+	if a := buf.String(); a != exp {
+		t.Errorf("** got:\n\t%s\nexpected:\n\t%s", a, exp)
+	}
+
+	err = reg.ExecuteTemplate(&buf, "bad", true)
+	if err == nil || !strings.Contains(err.Error(), `<c-badge>: prop count: cannot convert "three" to int`) {
+		t.Errorf("** bad: error = %v", err)
+	}
+}
+
+func TestRegistryPropsChecked(t *testing.T) {
+	reg := NewRegistry()
+	reg.Render("c-badge", func(p badgeProps) template.HTML { return "" })
+	reg.AddTemplate("page", `<c-badge color="red" />`)
+	err := reg.Compile()
+	if err == nil || err.Error() != "page: c-badge: line 1: unknown prop color of <c-badge>" {
+		t.Errorf("** Compile() error = %v", err)
+	}
+}
+
+func TestGenerateGo(t *testing.T) {
+	reg := NewRegistry()
+	reg.Render("c-badge", func(p badgeProps) template.HTML { return "" })
+	reg.AddTemplate("c-user-card", "---\nprops: user-name, avatar\nrequired: user-name\n---\n<card>{{.Args.body}}</card>")
+	reg.AddTemplate("c-box", "<box>{{.Args.body}}</box>")
+	reg.Render("c-cell", func(p struct {
+		Badge *badgeProps `mc:",required"`
+		Tags  []string
+		At    time.Time
+		Any   any
+	}) template.HTML {
+		return ""
+	})
+
+	var buf strings.Builder
+	err := reg.GenerateGo(&buf, GenerateOptions{Package: "views", PkgPath: importPath, Registry: "Components"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "// Code generated by minicomponents. DO NOT EDIT.\n" +
+		"\n" +
+		"package views\n" +
+		"\n" +
+		"import (\n" +
+		"\t\"github.com/andreyvit/minicomponents\"\n" +
+		"\t\"io\"\n" +
+		"\t\"time\"\n" +
+		")\n" +
+		"\n" +
+		"func RenderBadge(w io.Writer, p badgeProps, body func(io.Writer) error) error {\n" +
+		"\targs := minicomponents.StructArgs(p)\n" +
+		"\tif body != nil {\n" +
+		"\t\targs[\"body\"] = body\n" +
+		"\t}\n" +
+		"\treturn Components.RenderComponent(w, \"c-badge\", nil, args)\n" +
+		"}\n" +
+		"\n" +
+		"func RenderBox(w io.Writer, args map[string]any, body func(io.Writer) error) error {\n" +
+		"\targs = minicomponents.Args(args)\n" +
+		"\tif body != nil {\n" +
+		"\t\targs[\"body\"] = body\n" +
+		"\t}\n" +
+		"\treturn Components.RenderComponent(w, \"c-box\", nil, args)\n" +
+		"}\n" +
+		"\n" +
+		"type CellProps struct {\n" +
+		"\tBadge *badgeProps `mc:\"badge,required\"`\n" +
+		"\tTags  []string    `mc:\"tags\"`\n" +
+		"\tAt    time.Time   `mc:\"at\"`\n" +
+		"\tAny   any         `mc:\"any\"`\n" +
+		"}\n" +
+		"\n" +
+		"func RenderCell(w io.Writer, p CellProps) error {\n" +
+		"\targs := minicomponents.StructArgs(p)\n" +
+		"\treturn Components.RenderComponent(w, \"c-cell\", nil, args)\n" +
+		"}\n" +
+		"\n" +
+		"type UserCardProps struct {\n" +
+		"\tUserName any `mc:\"user-name,required\"`\n" +
+		"\tAvatar   any `mc:\"avatar\"`\n" +
+		"}\n" +
+		"\n" +
+		"func RenderUserCard(w io.Writer, p UserCardProps) error {\n" +
+		"\targs := minicomponents.StructArgs(p)\n" +
+		"\treturn Components.RenderComponent(w, \"c-user-card\", nil, args)\n" +
+		"}\n"
+	if a := buf.String(); a != exp {
+		t.Errorf("** GenerateGo returned:\n%s\nexpected:\n%s", a, exp)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "views.go", buf.String(), parser.AllErrors); err != nil {
+		t.Errorf("** GenerateGo returned invalid Go: %v", err)
+	}
+	if src, err := format.Source([]byte(buf.String())); err != nil || string(src) != buf.String() {
+		t.Errorf("** GenerateGo returned unformatted Go: %v", err)
+	}
+}
+
+func TestRenderComponent(t *testing.T) {
+	reg := newTestRegistry()
+	reg.Render("c-badge", func(p badgeProps) template.HTML {
+		return template.HTML(fmt.Sprintf("<badge>%s: %s</badge>", template.HTMLEscapeString(p.Label), p.Body))
+	})
+	if err := reg.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	body := func(w io.Writer) error {
+		_, err := io.WriteString(w, "<b>hi</b>")
+		return err
+	}
+	must(0, reg.RenderComponent(&buf, "c-box", nil, map[string]any{"body": body}))
+	buf.WriteString("|")
+	must(0, reg.RenderComponent(&buf, "c-badge", nil, StructArgs(badgeProps{Label: "x<y", Body: "<i>b</i>"})))
+	buf.WriteString("|")
+	must(0, reg.RenderComponent(&buf, "c-card", nil, Args("title", "t", "body", body)))
+	buf.WriteString("|")
+	must(0, reg.RenderComponent(&buf, "c-icon", nil, Args("name", "star")))
+
+	exp := `<box><b>hi</b></box>|<badge>x&lt;y: <i>b</i></badge>|<card title="T"><b>hi</b></card>|<i class="icon-star"></i>`
+	if a := buf.String(); a != exp {
+		t.Errorf("** got:\n\t%s\nexpected:\n\t%s", a, exp)
+	}
+}
+
+func TestRenderComponentBodies(t *testing.T) {
+	reg := newTestRegistry()
+	reg.AddTemplate("c-list", `<list><c-slot-body data="a" />,<c-slot-body data="b" /></list>`)
+	if err := reg.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		comp string
+		data any
+		body any
+		exp  string
+	}{
+		{"string", "c-box", nil, "a<b", `<box>a&lt;b</box>`},
+		{"html", "c-box", nil, template.HTML("<b>b</b>"), `<box><b>b</b></box>`},
+		{"template", "c-box", "data", TemplateBody(`<c-icon name="star" /> {{.}}`), `<box><i class="icon-star"></i> data</box>`},
+		{"template with nil data", "c-box", nil, TemplateBody(`<c-icon name="star" />`), `<box><i class="icon-star"></i></box>`},
+		{"data func", "c-box", 42, func(w io.Writer, data any) error {
+			_, err := fmt.Fprintf(w, "<%v>", data)
+			return err
+		}, `<box><42></box>`},
+
+		{"slot template", "c-list", nil, TemplateBody(`<i>{{.}}</i>`), `<list><i>a</i>,<i>b</i></list>`},
+		{"slot func", "c-list", nil, SlotFunc(func(w io.Writer, data any) error {
+			_, err := fmt.Fprintf(w, "[%v]", data)
+			return err
+		}), `<list>[a],[b]</list>`},
+		{"slot string", "c-list", nil, "x&y", `<list>x&amp;y,x&amp;y</list>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf strings.Builder
+			err := reg.RenderComponent(&buf, tt.comp, tt.data, Args("body", tt.body))
+			if err != nil {
+				t.Fatalf("** RenderComponent failed: %v", err)
+			}
+			if a := buf.String(); a != tt.exp {
+				t.Errorf("** got:\n\t%s\nexpected:\n\t%s", a, tt.exp)
+			}
+		})
+	}
+}
+
+func TestRenderString(t *testing.T) {
+	reg := newTestRegistry()
+	reg.SetSnippetLimits(SnippetLimits{MaxSize: 100, MaxComponents: 2, MaxCached: 2})
+	if err := reg.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	render := func(code string, data any) (string, error) {
+		var buf strings.Builder
+		err := reg.RenderString(&buf, code, data)
+		return buf.String(), err
+	}
+
+	for i := 0; i < 2; i++ {
+		out, err := render(`<c-box><c-icon name="warn" /> {{.Msg}}</c-box>`, map[string]any{"Msg": "<careful>"})
+		if exp := `<box><i class="icon-warn"></i> &lt;careful&gt;</box>`; err != nil || out != exp {
+			t.Errorf("** RenderString = %q, %v; expected %q", out, err, exp)
+		}
+	}
+	if n := len(reg.state.Load().snippets); n != 1 {
+		t.Errorf("** cached %d snippets, expected 1", n)
+	}
+
+	if _, err := render(strings.Repeat("x", 101), nil); err == nil || err.Error() != "snippet is too large: 101 bytes, max 100" {
+		t.Errorf("** too large: error = %v", err)
+	}
+	if _, err := render(`<c-box><c-box><c-box/></c-box></c-box>`, nil); err == nil || err.Error() != "snippet is too complex: 3 components, max 2" {
+		t.Errorf("** too complex: error = %v", err)
+	}
+	if _, err := render(`<c-nope/>`, nil); err == nil || err.Error() != "c-nope: line 1: unknown component <c-nope>" {
+		t.Errorf("** unknown component: error = %v", err)
+	}
+
+	for data, exp := range map[any]string{nil: "[]no", false: "[false]no", 0: "[0]no", "x": "[x]yes"} {
+		if out, err := render(`[{{.}}]{{if .}}yes{{else}}no{{end}}`, data); err != nil || out != exp {
+			t.Errorf("** RenderString with %v = %q, %v; expected %q", data, out, err, exp)
+		}
+	}
+
+	cached := func(code string) bool {
+		return reg.state.Load().snippets["snippet___"+hashString(code)] != nil
+	}
+	must(render(`a`, nil))
+	must(render(`b`, nil))
+	must(render(`a`, nil))
+	must(render(`c`, nil))
+	if !cached(`a`) || cached(`b`) || !cached(`c`) {
+		t.Errorf("** expected the least recently used snippet to be evicted")
+	}
+}
+
+func TestRenderStringConcurrent(t *testing.T) {
+	reg := newTestRegistry()
+	must(0, reg.Compile())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf strings.Builder
+			if err := reg.RenderString(&buf, `<c-box>{{.}}</c-box>`, "x"); err != nil || buf.String() != "<box>x</box>" {
+				t.Errorf("** RenderString = %q, %v", buf.String(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(reg.state.Load().snippets); n != 1 {
+		t.Errorf("** cached %d snippets, expected 1", n)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Now().Add(-time.Hour)
+	write := func(name, code string) {
+		p := filepath.Join(dir, name)
+		must(0, os.MkdirAll(filepath.Dir(p), 0o755))
+		must(0, os.WriteFile(p, []byte(code), 0o644))
+		mtime = mtime.Add(time.Second)
+		must(0, os.Chtimes(p, mtime, mtime))
+	}
+	write("components/c-card.html", `<card>{{.Args.body}}</card>`)
+	write("pages/home.html", `<c-card>{{.}}</c-card>`)
+
+	reg := NewRegistry()
+	var reported []error
+	reg.OnError(func(err error) { reported = append(reported, err) })
+	if err := reg.AddDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	render := func() string {
+		var buf strings.Builder
+		if err := reg.ExecuteTemplate(&buf, "pages/home", "hi"); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	if a, e := render(), "<card>hi</card>"; a != e {
+		t.Errorf("** got %q, expected %q", a, e)
+	}
+
+	if changed, err := reg.Reload(); changed || err != nil {
+		t.Errorf("** Reload() with no changes = %v, %v", changed, err)
+	}
+
+	write("components/c-card.html", `<div class="card">{{.Args.body}}</div>`)
+	if changed, err := reg.Reload(); !changed || err != nil {
+		t.Errorf("** Reload() = %v, %v", changed, err)
+	}
+	if a, e := render(), `<div class="card">hi</div>`; a != e {
+		t.Errorf("** got %q, expected %q", a, e)
+	}
+
+	write("pages/home.html", `<c-card>{{.}}`)
+	if _, err := reg.Reload(); err == nil || err.Error() != "pages/home: c-card: line 1: missing </c-card>" {
+		t.Errorf("** Reload() error = %v", err)
+	}
+	if a, e := render(), `<div class="card">hi</div>`; a != e {
+		t.Errorf("** got %q after failed reload, expected the last good output %q", a, e)
+	}
+	if reg.LastError() == nil || len(reported) != 1 {
+		t.Errorf("** LastError() = %v, reported %v", reg.LastError(), reported)
+	}
+
+	write("pages/home.html", `<c-card>{{.}}!</c-card>`)
+	if _, err := reg.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a, e := render(), `<div class="card">hi!</div>`; a != e {
+		t.Errorf("** got %q, expected %q", a, e)
+	}
+	if reg.LastError() != nil {
+		t.Errorf("** LastError() = %v after a successful reload", reg.LastError())
+	}
+}
+
+func TestDependencyGraph(t *testing.T) {
+	reg := newTestRegistry()
+	reg.AddTemplate("c-layout", `<main><c-icon name="logo" /><c-slot-body /></main>`)
+	reg.AddTemplate("c-tree", `<li>{{.Data.Name}}{{range .Data.Children}}<c-tree data={{.}} />{{end}}</li>`)
+	reg.AddTemplate("page", `<c-layout><c-box><c-card title="x" /></c-box>{{if .}}<c-tree data={{.}} />{{end}}</c-layout>`)
+	if err := reg.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, e := fmt.Sprint(reg.Dependencies("page")), "[c-box c-card c-layout c-tree]"; a != e {
+		t.Errorf("** Dependencies(page) = %s, expected %s", a, e)
+	}
+	if a, e := fmt.Sprint(reg.Dependents("c-icon")), "[c-layout]"; a != e {
+		t.Errorf("** Dependents(c-icon) = %s, expected %s", a, e)
+	}
+	if a, e := fmt.Sprint(reg.AllDependents("c-icon")), "[c-layout page]"; a != e {
+		t.Errorf("** AllDependents(c-icon) = %s, expected %s", a, e)
+	}
+
+	var dot strings.Builder
+	must(0, reg.Graph().WriteDOT(&dot))
+	expDOT := "digraph components {\n" +
+		"\t\"c-box\";\n\t\"c-card\";\n\t\"c-icon\";\n\t\"c-layout\";\n\t\"c-tree\";\n\t\"page\";\n" +
+		"\t\"c-layout\" -> \"c-icon\";\n" +
+		"\t\"c-tree\" -> \"c-tree\" [style=dashed];\n" +
+		"\t\"page\" -> \"c-box\";\n" +
+		"\t\"page\" -> \"c-card\";\n" +
+		"\t\"page\" -> \"c-layout\";\n" +
+		"\t\"page\" -> \"c-tree\" [style=dashed];\n" +
+		"}\n"
+	if a := dot.String(); a != expDOT {
+		t.Errorf("** WriteDOT:\n%s\nexpected:\n%s", a, expDOT)
+	}
+
+	j := string(must(json.Marshal(reg.Graph())))
+	if !strings.Contains(j, `{"from":"c-tree","to":"c-tree","guarded":true}`) || !strings.Contains(j, `{"from":"c-layout","to":"c-icon"}`) {
+		t.Errorf("** JSON graph: %s", j)
+	}
+}
+
+func TestUnguardedCycle(t *testing.T) {
+	reg := NewRegistry()
+	reg.AddTemplate("c-a", `<c-b />`)
+	reg.AddTemplate("c-b", `{{with .Data}}{{end}}<c-c />`)
+	reg.AddTemplate("c-c", `<c-a />`)
+	err := reg.Compile()
+	if err == nil || err.Error() != "component includes itself without an if, range or with guard: c-a > c-b > c-c > c-a" {
+		t.Errorf("** Compile() error = %v", err)
+	}
+}
+
+func TestReloadRewritesDependents(t *testing.T) {
+	reg := NewRegistry()
+	reg.AddTemplate("c-box", `<box>{{.Args.body}}</box>`)
+	reg.AddTemplate("c-other", `other`)
+	reg.AddTemplate("page", `<c-box>{{.}}</c-box>`)
+	reg.AddTemplate("other", `<c-other />`)
+	must(0, reg.Compile())
+	pageCode, otherCode := reg.rewritten["page"], reg.rewritten["other"]
+
+	reg.AddTemplate("c-box", `<box><c-slot-body /></box>`)
+	must(0, reg.Compile())
+	if reg.rewritten["page"] == pageCode {
+		t.Errorf("** page was not rewritten after c-box started using slots")
+	}
+	if reg.rewritten["other"] != otherCode {
+		t.Errorf("** other was rewritten although it does not use c-box")
+	}
+	var buf strings.Builder
+	must(0, reg.ExecuteTemplate(&buf, "page", "hi"))
+	if a, e := buf.String(), "<box>hi</box>"; a != e {
+		t.Errorf("** got %q, expected %q", a, e)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	reg := NewRegistry()
+	reg.SetMaxDepth(5)
+	reg.AddTemplate("c-tree", `<li>{{range .Data.Children}}<c-tree data={{.}} />{{end}}</li>`)
+	reg.AddTemplate("c-wrapper", `<div><c-slot-body /></div>`)
+	reg.AddTemplate("page", `<c-wrapper><c-tree data={{.}} /></c-wrapper>`)
+	must(0, reg.Compile())
+
+	node := map[string]any{}
+	node["Children"] = []any{node}
+	var buf strings.Builder
+	err := reg.ExecuteTemplate(&buf, "page", node)
+	if err == nil || !strings.Contains(err.Error(), "component nesting exceeds 5 levels: c-wrapper > c-tree > c-tree > c-tree > c-tree > c-tree") {
+		t.Errorf("** ExecuteTemplate error = %v", err)
+	}
+
+	finite := map[string]any{"Children": []any{map[string]any{}}}
+	buf.Reset()
+	if err := reg.ExecuteTemplate(&buf, "page", finite); err != nil {
+		t.Errorf("** ExecuteTemplate failed: %v", err)
+	}
+}
+
+func TestCallFrameString(t *testing.T) {
+	var f *callFrame
+	for i := 1; i <= 20; i++ {
+		f = f.push(fmt.Sprintf("c-%d", i), "")
+	}
+	exp := "c-1 > c-2 > c-3 > c-4 > c-5 > c-6 > c-7 > c-8 > … 4 more … > c-13 > c-14 > c-15 > c-16 > c-17 > c-18 > c-19 > c-20"
+	if a := f.String(); a != exp {
+		t.Errorf("** got %s, expected %s", a, exp)
+	}
+}
+
+func TestComponentError(t *testing.T) {
+	reg := NewRegistry()
+	reg.AddTemplate("c-panel", `<div><c-slot-body /></div>`)
+	reg.Render("c-fail", func(rd *RenderData) (template.HTML, error) {
+		return "", errors.New("boom")
+	})
+	reg.AddTemplate("page", "<h1>Title</h1>\n<c-panel>\n  <c-fail />\n</c-panel>")
+	must(0, reg.Compile())
+
+	err := reg.ExecuteTemplate(io.Discard, "page", true)
+	var ce *ComponentError
+	if !errors.As(err, &ce) {
+		t.Fatalf("** ExecuteTemplate error = %v, expected a ComponentError", err)
+	}
+	var stack []string
+	for _, f := range ce.Stack {
+		stack = append(stack, f.String())
+	}
+	exp := "<c-fail> at page:3 | body of <c-panel> at page:2 | <c-panel> at page:2"
+	if a := strings.Join(stack, " | "); a != exp {
+		t.Errorf("** stack = %s, expected %s", a, exp)
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "boom") || !strings.Contains(msg, "[body of <c-panel> at page:2]") || strings.Contains(msg, "__body__") {
+		t.Errorf("** unexpected error message: %s", msg)
+	}
+}
+
+func TestLazyBody(t *testing.T) {
+	var calls int
+	reg := NewRegistry()
+	reg.Render("c-count", func(rd *RenderData) template.HTML {
+		calls++
+		return "x"
+	})
+	reg.AddTemplate("c-off", `{{if false}}{{.Args.body}}{{end}}off`)
+	reg.AddTemplate("c-twice", `[{{.Args.body}}|{{- $.Args.body -}}]`)
+	reg.AddTemplate("c-with", `{{with .Args.body}}[{{.}}]{{end}}`)
+	reg.AddTemplate("c-piped", `{{.Args.body | printf "(%s)"}}`)
+	reg.AddTemplate("c-data", `{{.Data.body}}`)
+	reg.Prepare("c-data", func(p struct{ Body *Body }) any {
+		return map[string]any{"body": p.Body}
+	})
+	reg.Render("c-go", func(rd *RenderData) template.HTML {
+		return "<go>" + rd.Args["body"].(template.HTML) + "</go>"
+	})
+	reg.AddTemplate("page", `<c-off><c-count /></c-off> <c-twice><c-count /></c-twice> <c-with><b>w</b></c-with> <c-piped>p</c-piped> <c-data><b>d</b></c-data> <c-go><b>g</b></c-go>`)
+	must(0, reg.Compile())
+
+	var buf strings.Builder
+	must(0, reg.ExecuteTemplate(&buf, "page", true))
+	if a, e := buf.String(), "off [x|x] [<b>w</b>] (p) <b>d</b> <go><b>g</b></go>"; a != e {
+		t.Errorf("** got %s, expected %s", a, e)
+	}
+	if calls != 2 {
+		t.Errorf("** body rendered %d times, expected 2", calls)
+	}
+
+	buf.Reset()
+	must(0, reg.RenderString(&buf, `<c-with>{{.}}</c-with>`, "s"))
+	if a, e := buf.String(), "[s]"; a != e {
+		t.Errorf("** RenderString got %s, expected %s", a, e)
+	}
+}
+
+func TestLazyBodyEscapers(t *testing.T) {
+	reg := NewRegistry()
+	reg.AddTemplate("c-link", `<a href="/q?x={{.Args.q | urlquery}}">{{.Args.body}}</a>`)
+	reg.AddTemplate("page", `<a href="/q?x={{.Q | urlquery}}">{{.T | html}}</a> <c-define name=c-local>({{with .Args.body}}{{.}}{{end}})</c-define><c-local><c-link q={{.Q}}><b>{{.T}}</b></c-link></c-local>`)
+	must(0, reg.Compile())
+
+	var buf strings.Builder
+	must(0, reg.ExecuteTemplate(&buf, "page", map[string]any{"Q": "a b", "T": "<t>"}))
+	if a, e := buf.String(), `<a href="/q?x=a&#43;b">&lt;t&gt;</a> (<a href="/q?x=a&#43;b"><b>&lt;t&gt;</b></a>)`; a != e {
+		t.Errorf("** got %s, expected %s", a, e)
+	}
+}
+
+func TestStreamingBodies(t *testing.T) {
+	reg := newTestRegistry()
+	reg.AddTemplate("c-list", `<list><c-slot-body data="a" /></list>`)
+	reg.AddTemplate("c-titled", `<div title="{{.Args.body}}"></div>`)
+	must(0, reg.Compile())
+
+	var out strings.Builder
+	direct := func(w io.Writer) error {
+		if w != &out {
+			return errors.New("body is buffered")
+		}
+		_, err := io.WriteString(w, "<b>x</b>")
+		return err
+	}
+	must(0, reg.RenderComponent(&out, "c-box", nil, Args("body", direct)))
+	must(0, reg.RenderComponent(&out, "c-list", nil, Args("body", direct)))
+	if a, e := out.String(), `<box><b>x</b></box><list><b>x</b></list>`; a != e {
+		t.Errorf("** got %s, expected %s", a, e)
+	}
+
+	// bodies in attributes are buffered so that they can be escaped
+	out.Reset()
+	must(0, reg.RenderComponent(&out, "c-titled", nil, Args("body", template.HTML("<b>x</b>"))))
+	if a, e := out.String(), `<div title="x"></div>`; a != e {
+		t.Errorf("** got %s, expected %s", a, e)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	newReg := func(page string) *Registry {
+		reg := newTestRegistry()
+		reg.AddTemplate("page", page)
+		return reg
+	}
+	var buf bytes.Buffer
+	must(0, newReg(`<c-box>hi</c-box>`).WriteBundle(&buf))
+	data := buf.Bytes()
+
+	var b bundle
+	must(0, json.Unmarshal(data, &b))
+	b.Templates["page"].Code = "{{with .Data}}BUNDLED{{end}}"
+	tampered := must(json.Marshal(b))
+
+	reg := newReg(`<c-box>hi</c-box>`).UseBundle(tampered)
+	must(0, reg.Compile())
+	var out strings.Builder
+	must(0, reg.ExecuteTemplate(&out, "page", true))
+	if a := out.String(); a != "BUNDLED" {
+		t.Errorf("** bundled code not used, got %s", a)
+	}
+
+	reg = newReg(`<c-box>changed</c-box>`).UseBundle(tampered)
+	must(0, reg.Compile())
+	out.Reset()
+	must(0, reg.ExecuteTemplate(&out, "page", true))
+	if a := out.String(); a != "<box>changed</box>" {
+		t.Errorf("** stale bundle entry used, got %s", a)
+	}
+
+	if err := newReg(`<c-box>hi</c-box>`).CheckBundle(data); err != nil {
+		t.Errorf("** CheckBundle failed: %v", err)
+	}
+	if err := reg.CheckBundle(data); err == nil || err.Error() != "bundle is out of date, regenerate it: page" {
+		t.Errorf("** CheckBundle error = %v", err)
+	}
+
+	oldHash := rewriterHash
+	rewriterHash = "changed rewriter"
+	err := newReg(`<c-box>hi</c-box>`).CheckBundle(data)
+	rewriterHash = oldHash
+	if err == nil {
+		t.Errorf("** CheckBundle accepted a bundle written by another rewriter")
+	}
+
+	buf.Reset()
+	must(0, GenerateBundle(&buf, GenerateOptions{Package: "views", Registry: "Views"}, "bundle.json"))
+	if s := buf.String(); !strings.Contains(s, "//go:embed bundle.json\nvar minicomponentsBundle []byte") || !strings.Contains(s, "Views.UseBundle(minicomponentsBundle)") {
+		t.Errorf("** unexpected generated code:\n%s", s)
+	}
+}
+
+func TestCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	reg := newTestRegistry().SetCacheDir(dir)
+	reg.AddTemplate("page", `<c-box>hi</c-box>`)
+	must(0, reg.Compile())
+
+	files := must(filepath.Glob(filepath.Join(dir, "*.json")))
+	if len(files) != 3 {
+		t.Fatalf("** cached %d templates, expected 3", len(files))
+	}
+	for _, f := range files {
+		var e cacheEntry
+		must(0, json.Unmarshal(must(os.ReadFile(f)), &e))
+		if strings.Contains(e.Code, "<box>") {
+			continue
+		}
+		if strings.Contains(e.Code, "c-box") {
+			e.Code = "{{with .Data}}CACHED{{end}}"
+			must(0, os.WriteFile(f, must(json.Marshal(e)), 0o644))
+		}
+	}
+
+	reg = newTestRegistry().SetCacheDir(dir)
+	reg.AddTemplate("page", `<c-box>hi</c-box>`)
+	must(0, reg.Compile())
+	var out strings.Builder
+	must(0, reg.ExecuteTemplate(&out, "page", true))
+	if a := out.String(); a != "CACHED" {
+		t.Errorf("** cached code not used, got %s", a)
+	}
+}
+
+func TestPrivateTemplates(t *testing.T) {
+	reg := NewRegistry()
+	reg.AddTemplate("c-table", `{{define "@@__row"}}<tr><c-@@__cell text={{$@item}} /></tr>{{end}}{{define "@@__cell"}}<td>{{$@text}}</td>{{end}}<table>{{range .Args.rows}}<c-@@__row item={{.}} />{{end}}</table>`)
+	reg.AddTemplate("c-list", `{{define "@@__row"}}<li>{{.}}</li>{{end}}<ul>{{range .Args.rows}}{{template "@@__row" .}}{{end}}</ul>`)
+	reg.AddTemplate("page", `<c-table rows={{.}} /><c-list rows={{.}} />`)
+	must(0, reg.Compile())
+
+	var buf strings.Builder
+	must(0, reg.ExecuteTemplate(&buf, "page", []string{"a", "b"}))
+	if a, e := buf.String(), "<table><tr><td>a</td></tr><tr><td>b</td></tr></table><ul><li>a</li><li>b</li></ul>"; a != e {
+		t.Errorf("** got %s, expected %s", a, e)
+	}
+
+	err := reg.RenderString(&buf, `{{template "c-table__row" "x"}}`, nil)
+	if a, e := fmt.Sprint(err), `snippet___`; !strings.Contains(a, e) || !strings.Contains(a, "calls template c-table__row, which is private to c-table") {
+		t.Errorf("** RenderString error %s", a)
+	}
+
+	tests := []struct {
+		code   string
+		expErr string
+	}{
+		{`{{template "c-table__row" "x"}}`, `other: calls template c-table__row, which is private to c-table`},
+		{`{{define "c-table__row"}}{{end}}`, `other: defines template c-table__row, which is private to c-table`},
+		{`<c-@@__missing />`, `other: calls undefined template other__missing`},
+		// names that merely look private are public
+		{`{{define "c-table__extra"}}x{{end}}{{template "c-table__extra"}}`, `<nil>`},
+	}
+	for _, tt := range tests {
+		reg.AddTemplate("other", tt.code)
+		if a := fmt.Sprint(reg.Compile()); a != tt.expErr {
+			t.Errorf("** Compile of %s returned %s, expected %s", tt.code, a, tt.expErr)
+		}
+	}
+}
+
+func TestInlineDefine(t *testing.T) {
+	reg := NewRegistry()
+	reg.AddTemplate("page", "<c-define name=\"c-price-cell\">\n<td>${{$@amount}}</td></c-define>\n<tr>{{range .}}<c-price-cell amount={{.}} />{{end}}</tr>")
+	reg.AddTemplate("other", `<c-price-cell amount=1 />`)
+	err := reg.Compile()
+	if a, e := fmt.Sprint(err), "other: c-price-cell: line 1: unknown component <c-price-cell>"; a != e {
+		t.Fatalf("** Compile() error = %s, expected %s", a, e)
+	}
+	reg.AddTemplate("other", ``)
+	must(0, reg.Compile())
+
+	var buf strings.Builder
+	must(0, reg.ExecuteTemplate(&buf, "page", []int{1, 2}))
+	if a, e := buf.String(), "\n<tr>\n<td>$1</td>\n<td>$2</td></tr>"; a != e {
+		t.Errorf("** got %q, expected %q", a, e)
+	}
+}
+
+func TestDynamicComponent(t *testing.T) {
+	reg := NewRegistry()
+	reg.AddTemplate("c-quote", `<q title="{{$@title}}">{{$@body}}</q>`)
+	reg.AddTemplate("c-list", `<ul>{{range $@items}}<li>{{.}} <c-slot-body /></li>{{end}}</ul>`)
+	reg.Render("c-note", func(rd *RenderData) (template.HTML, error) {
+		return "<small>" + rd.Args["body"].(template.HTML) + "</small>", nil
+	})
+	reg.AddTemplate("page", "{{range .}}<c-dynamic is={{.Kind}} title={{.Title}} items={{.Items}}>by {{.Title}}</c-dynamic>\n{{end}}")
+	must(0, reg.Compile())
+
+	blocks := []map[string]any{
+		{"Kind": "c-quote", "Title": "Q"},
+		{"Kind": "c-list", "Title": "L", "Items": []string{"a", "b"}},
+		{"Kind": "c-note", "Title": "N"},
+	}
+	var buf strings.Builder
+	must(0, reg.ExecuteTemplate(&buf, "page", blocks))
+	exp := "<q title=\"Q\">by Q</q>\n<ul><li>a by L</li><li>b by L</li></ul>\n<small>by N</small>\n"
+	if a := buf.String(); a != exp {
+		t.Errorf("** got:\n\t%s\nexpected:\n\t%s", a, exp)
+	}
+
+	err := reg.ExecuteTemplate(io.Discard, "page", []map[string]any{{"Kind": "c-nope"}})
+	if a, e := fmt.Sprint(err), "unknown component <c-nope>\n\tin <c-dynamic> at page:1"; !strings.HasSuffix(a, e) {
+		t.Errorf("** ExecuteTemplate error = %s, expected it to end with %s", a, e)
+	}
+
+	reg.AddTemplate("page", `<c-dynamic title="x" />`)
+	if a, e := fmt.Sprint(reg.Compile()), "page: c-dynamic: line 1: missing is attr"; a != e {
+		t.Errorf("** Compile() error = %s, expected %s", a, e)
+	}
+}
+
+func TestEach(t *testing.T) {
+	type row struct {
+		ID   int
+		Name string
+	}
+	reg := NewRegistry()
+	reg.AddTemplate("c-row", `<b>{{.Data.Name}}</b>{{if $@selected}}*{{end}}`)
+	reg.Render("c-cell", func(props struct{ Row row }) template.HTML {
+		return template.HTML(template.HTMLEscapeString(props.Row.Name))
+	})
+	reg.AddTemplate("page", `<ul><c-each items={{.}} key="ID" component="c-row" tag="li" selected={{eq .ID 2}} /></ul>`+
+		`<c-each items={{.}} key={{printf "%03d" .ID}} component="c-cell" as="row" prefix="cell" />`)
+	must(0, reg.Compile())
+
+	rows := []row{{1, "a"}, {2, "b&c"}}
+	var buf strings.Builder
+	must(0, reg.ExecuteTemplate(&buf, "page", rows))
+	exp := `<ul><li id="row-1"><b>a</b></li><li id="row-2"><b>b&amp;c</b>*</li></ul>` +
+		`<div id="cell-001">a</div><div id="cell-002">b&amp;c</div>`
+	if a := buf.String(); a != exp {
+		t.Errorf("** got:\n\t%s\nexpected:\n\t%s", a, exp)
+	}
+
+	buf.Reset()
+	must(0, reg.RenderItem(&buf, "c-row", rows[1], EachOptions{Key: "ID", Tag: "li", OOB: true, Args: map[string]any{"selected": true}}))
+	if a, e := buf.String(), `<li id="row-2" hx-swap-oob="true"><b>b&amp;c</b>*</li>`; a != e {
+		t.Errorf("** RenderItem got:\n\t%s\nexpected:\n\t%s", a, e)
+	}
+	if err := reg.RenderItem(&buf, "c-row", rows[1], EachOptions{Key: "ID", Args: map[string]any{"key": 1}}); err == nil {
+		t.Errorf("** RenderItem accepted an arg named key")
+	}
+	buf.Reset()
+	must(0, reg.RenderItem(&buf, "c-cell", rows[1], EachOptions{Key: "ID", As: "row", Prefix: "cell"}))
+	if a, e := buf.String(), `<div id="cell-2">b&amp;c</div>`; a != e {
+		t.Errorf("** RenderItem as got:\n\t%s\nexpected:\n\t%s", a, e)
+	}
+	buf.Reset()
+	must(0, reg.RenderItem(&buf, "c-row", map[string]any{"Name": "m", "ID": "x&y"}, EachOptions{Key: "ID"}))
+	if a, e := buf.String(), `<div id="row-x&amp;y"><b>m</b></div>`; a != e {
+		t.Errorf("** RenderItem map got:\n\t%s\nexpected:\n\t%s", a, e)
+	}
+	for _, tt := range []struct {
+		item   any
+		key    string
+		expErr string
+	}{
+		{rows[0], "Missing", "<c-row>: key Missing: can't evaluate field Missing in type minicomponents.row"},
+		{nil, "ID", "<c-row>: key ID: nil item"},
+		{rows[0], "ID|x", `<c-row>: key must be a field name, got "ID|x"`},
+	} {
+		if err := reg.RenderItem(&buf, "c-row", tt.item, EachOptions{Key: tt.key}); fmt.Sprint(err) != tt.expErr {
+			t.Errorf("** RenderItem with key %s error = %v, expected %s", tt.key, err, tt.expErr)
+		}
+	}
+	if n := len(reg.state.Load().snippets); n != 0 {
+		t.Errorf("** RenderItem compiled %d snippets", n)
+	}
+
+	reg.AddTemplate("page", `<c-each items={{.}} key="ID" component="c-row" oob={{eq .ID 2}} />`)
+	must(0, reg.Compile())
+	buf.Reset()
+	must(0, reg.ExecuteTemplate(&buf, "page", rows))
+	if a, e := buf.String(), `<div id="row-1"><b>a</b></div><div id="row-2" hx-swap-oob="true"><b>b&amp;c</b></div>`; a != e {
+		t.Errorf("** oob expression got:\n\t%s\nexpected:\n\t%s", a, e)
+	}
+
+	for _, tt := range []struct{ code, expErr string }{
+		{`<c-each items={{.}} key="ID" />`, "page: c-each: line 1: missing component attr"},
+		{`<c-each items={{.}} key="ID" component="c-row" oob="maybe" />`, `page: c-each: line 1: oob must be true, false or {{...}}, got "maybe"`},
+	} {
+		reg.AddTemplate("page", tt.code)
+		if a := fmt.Sprint(reg.Compile()); a != tt.expErr {
+			t.Errorf("** Compile() error = %s, expected %s", a, tt.expErr)
+		}
+	}
+}
+
+func TestComponentStyles(t *testing.T) {
+	reg := NewRegistry()
+	reg.AddTemplate("c-card", "<style>.card { color: red }</style>\n<div class=\"card\"><c-badge /></div>")
+	reg.AddTemplate("c-badge", "<style scoped>b { color: blue }</style><b>!</b>")
+	reg.AddTemplate("c-extra", "<style>.extra {}</style><i>extra</i>")
+	reg.AddTemplate("c-plain", "<p></p>")
+	reg.AddTemplate("page", "<head>{{$.ComponentStyles}}</head>\n<c-card /><c-plain /><c-dynamic is={{.}} />{{$.ComponentStyles}}{{$.ComponentStyles}}")
+	must(0, reg.Compile())
+
+	scope := "data-c-" + hashString("c-badge")[:8]
+	var buf strings.Builder
+	must(0, reg.ExecuteTemplate(&buf, "page", "c-extra"))
+	exp := "<head><style>\nb[" + scope + "] { color: blue }\n.card { color: red }\n</style></head>\n" +
+		"\n<div class=\"card\"><b " + scope + ">!</b></div><p></p><i>extra</i><style>\n.extra {}\n</style>"
+	if a := buf.String(); a != exp {
+		t.Errorf("** got:\n\t%s\nexpected:\n\t%s", a, exp)
+	}
+
+	buf.Reset()
+	must(0, reg.WriteStyles(&buf))
+	exp = "/* c-badge */\nb[" + scope + "] { color: blue }\n/* c-card */\n.card { color: red }\n/* c-extra */\n.extra {}\n"
+	if a := buf.String(); a != exp {
+		t.Errorf("** WriteStyles got:\n\t%s\nexpected:\n\t%s", a, exp)
+	}
+}
+
+func TestComponentScripts(t *testing.T) {
+	reg := NewRegistry()
+	reg.AddTemplate("c-row", "<script>initRow()</script>\n<script type=\"module\">import \"/row.js\"</script><tr>{{.Data}}</tr>")
+	reg.AddTemplate("c-chart", "<script src=\"/chart.js\"></script><script>initRow()</script><script>var n = {{.Data}}</script><canvas></canvas>")
+	reg.AddTemplate("c-extra", "<script>extra()</script><i>extra</i>")
+	reg.AddTemplate("c-map", "<script type=\"module\">const x = 1</script><div></div>")
+	reg.AddTemplate("page", "<c-for each={{.Rows}} as=\"row\"><c-row data={{$row}} /></c-for><c-chart data={{len .Rows}} /><c-dynamic is={{.Extra}} />\n{{$.ComponentScripts}}{{$.ComponentScripts}}")
+	must(0, reg.Compile())
+
+	var rows []int
+	for i := 0; i < 50; i++ {
+		rows = append(rows, i)
+	}
+	var buf strings.Builder
+	must(0, reg.ExecuteTemplate(&buf, "page", map[string]any{"Rows": rows, "Extra": "c-extra"}))
+	a := buf.String()
+	if n := strings.Count(a, "initRow()"); n != 1 {
+		t.Errorf("** initRow printed %d times", n)
+	}
+	if n := strings.Count(a, "<tr>"); n != 50 {
+		t.Errorf("** %d rows", n)
+	}
+	exp := "<canvas></canvas><i>extra</i>\n" +
+		"<script src=\"/chart.js\"></script>\n<script>initRow()</script>\n" +
+		"<script>extra()</script>\n<script type=\"module\">import \"/row.js\"</script>"
+	if !strings.HasSuffix(a, exp) {
+		t.Errorf("** got:\n\t%s\nexpected suffix:\n\t%s", a, exp)
+	}
+	if !strings.Contains(a, "<script>var n =  50 </script>") {
+		t.Errorf("** templated script not rendered in place:\n\t%s", a)
+	}
+
+	buf.Reset()
+	must(0, reg.WriteScripts(&buf))
+	exp = "/* c-chart */\ninitRow()\n/* c-extra */\nextra()\n"
+	if a := buf.String(); a != exp {
+		t.Errorf("** WriteScripts got:\n\t%s\nexpected:\n\t%s", a, exp)
+	}
+	modules := must(reg.ScriptModules())
+	if a := fmt.Sprint(modules); a != "map[c-map:const x = 1\n c-row:import \"/row.js\"\n]" {
+		t.Errorf("** ScriptModules got:\n\t%s", a)
+	}
+}
@@ -0,0 +1,309 @@
+package minicomponents
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// TemplateBody is a component body given as template source. It is
+// rewritten like any other template, so it may use components itself.
+type TemplateBody string
+
+// RenderComponent renders a single component outside of any page, passing
+// the same data that a <c-...> tag would. A body can be passed in args as
+// a string, template.HTML, TemplateBody, SlotFunc or func(io.Writer) error.
+func (r *Registry) RenderComponent(w io.Writer, name string, data any, args map[string]any) error {
+	cs, err := r.current()
+	if err != nil {
+		return err
+	}
+	return componentError(cs.renderComponent(w, name, data, args))
+}
+
+func (cs *compiledSet) renderComponent(w io.Writer, name string, data any, args map[string]any) error {
+	def := cs.defs[name]
+	if def == nil {
+		return fmt.Errorf("unknown component <%s>", name)
+	}
+
+	tmpl := cs.tmpl
+	bound := make(map[string]any, len(args)+1)
+	for k, v := range args {
+		if k != "body" {
+			bound[k] = v
+		}
+	}
+	var slotArgs []any
+	if body := args["body"]; body != nil {
+		if def.HasSlots {
+			slot, t, err := cs.slotBody(body)
+			if err != nil {
+				return fmt.Errorf("<%s> body: %w", name, err)
+			}
+			if t != nil {
+				tmpl = t
+			}
+			bound["bodyTemplate"] = slot
+			slotArgs = append(slotArgs, "bodyTemplate", slot)
+		} else {
+			bound["body"] = cs.lazyBody(name, body, data)
+		}
+	}
+	return cs.callComponent(w, cs.newRenderData(tmpl, name, nil, w), def, name, "", data, bound, slotArgs)
+}
+
+// callComponent renders a component with bound args from the template or Go
+// code of parent. slotArgs are the args that FuncThenTemplate components
+// pass on to their template along with the data returned by their func.
+func (cs *compiledSet) callComponent(w io.Writer, parent *RenderData, def *ComponentDef, name, pos string, data any, bound map[string]any, slotArgs []any) error {
+	tmpl := parent.ctx.tmpl
+	rd, err := parent.Call(name, pos, data)
+	if err != nil {
+		return err
+	}
+	rd.Args = bound
+
+	switch def.RenderMethod {
+	case RenderMethodTemplate:
+		return tmpl.ExecuteTemplate(w, def.templName(name), rd)
+	case RenderMethodFunc:
+		result, err := callFunc(cs.fmap[def.funcName(name)], rd)
+		if err != nil {
+			return err
+		}
+		return writeResult(w, result)
+	case RenderMethodFuncThenTemplate:
+		result, err := callFunc(cs.fmap[def.funcName(name)], rd)
+		if err != nil {
+			return err
+		}
+		slotArgs = append(slotArgs, "callerData", data)
+		return tmpl.ExecuteTemplate(w, def.templName(name), rd.Bind(result, slotArgs...))
+	default:
+		return fmt.Errorf("<%s>: unsupported render method %v", name, def.RenderMethod)
+	}
+}
+
+// EachOptions are the attrs of a <c-each> tag, see RenderItem.
+type EachOptions struct {
+	// Key is the field of the item that the id of its wrapper derives from.
+	Key    string
+	Tag    string
+	Prefix string
+	As     string
+	// OOB adds hx-swap-oob="true" to the wrapper, for htmx out-of-band
+	// swaps.
+	OOB bool
+	// Args are the other attrs, passed to the component.
+	Args map[string]any
+}
+
+// RenderItem renders a single item the way <c-each> renders each of its
+// items, including the wrapper tag with the id derived from the key, so
+// that the output can replace the item on the page.
+func (r *Registry) RenderItem(w io.Writer, comp string, item any, opt EachOptions) error {
+	cs, err := r.current()
+	if err != nil {
+		return err
+	}
+	tag, prefix := opt.Tag, opt.Prefix
+	if tag == "" {
+		tag = "div"
+	}
+	if prefix == "" {
+		prefix = strings.TrimPrefix(comp, "c-")
+	}
+	for _, name := range []string{tag, prefix, opt.As} {
+		if nameLen(name) != len(name) {
+			return fmt.Errorf("<%s>: invalid name %q", comp, name)
+		}
+	}
+	args := make(map[string]any, len(opt.Args)+1)
+	for name, v := range opt.Args {
+		if nameLen(name) != len(name) || eachAttrs[name] || name == opt.As {
+			return fmt.Errorf("<%s>: invalid arg name %q", comp, name)
+		}
+		args[name] = v
+	}
+	data := item
+	if opt.As != "" {
+		args[opt.As], data = item, nil
+	}
+	key, err := fieldPath(item, opt.Key)
+	if err != nil {
+		return fmt.Errorf("<%s>: %w", comp, err)
+	}
+
+	start := fmt.Sprintf(`<%s id="%s-%s"`, tag, prefix, template.HTMLEscapeString(fmt.Sprint(key)))
+	if opt.OOB {
+		start += ` hx-swap-oob="true"`
+	}
+	if _, err := io.WriteString(w, start+">"); err != nil {
+		return err
+	}
+	if err := cs.renderComponent(w, comp, data, args); err != nil {
+		return componentError(err)
+	}
+	_, err = io.WriteString(w, "</"+tag+">")
+	return err
+}
+
+// fieldPath evaluates a key like "ID" or "User.ID" on v the way {{.User.ID}}
+// would, for struct fields, map keys and methods without arguments.
+func fieldPath(v any, path string) (any, error) {
+	rv := reflect.ValueOf(v)
+	for _, name := range strings.Split(path, ".") {
+		if !isIdent(name) {
+			return nil, fmt.Errorf("key must be a field name, got %q", path)
+		}
+		if rv.IsValid() {
+			if m := rv.MethodByName(name); m.IsValid() && m.Type().NumIn() == 0 && m.Type().NumOut() == 1 {
+				rv = m.Call(nil)[0]
+				continue
+			}
+		}
+		for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+			if rv.IsNil() {
+				return nil, fmt.Errorf("key %s: nil pointer evaluating %s", path, name)
+			}
+			rv = rv.Elem()
+		}
+		if !rv.IsValid() {
+			return nil, fmt.Errorf("key %s: nil item", path)
+		}
+		switch rv.Kind() {
+		case reflect.Struct:
+			f := rv.FieldByName(name)
+			if !f.IsValid() || !f.CanInterface() {
+				return nil, fmt.Errorf("key %s: can't evaluate field %s in type %s", path, name, rv.Type())
+			}
+			rv = f
+		case reflect.Map:
+			if rv.Type().Key().Kind() != reflect.String {
+				return nil, fmt.Errorf("key %s: can't evaluate field %s in type %s", path, name, rv.Type())
+			}
+			rv = rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+			if !rv.IsValid() {
+				return nil, fmt.Errorf("key %s: map has no key %s", path, name)
+			}
+		default:
+			return nil, fmt.Errorf("key %s: can't evaluate field %s in type %v", path, name, rv.Type())
+		}
+	}
+	return rv.Interface(), nil
+}
+
+// eachAttrs are the attrs that <c-each> does not pass to the component.
+var eachAttrs = map[string]bool{"items": true, "key": true, "component": true, "tag": true, "prefix": true, "as": true, "oob": true}
+
+// lazyBody wraps bodies that need rendering into a *Body, so that they only
+// render if the component prints them.
+func (cs *compiledSet) lazyBody(comp string, body any, data any) any {
+	var render func(w io.Writer) error
+	switch body := body.(type) {
+	case func(io.Writer) error:
+		render = body
+	case func(io.Writer, any) error:
+		render = func(w io.Writer) error {
+			return body(w, data)
+		}
+	case SlotFunc:
+		render = func(w io.Writer) error {
+			return body(w, data)
+		}
+	case TemplateBody:
+		render = func(w io.Writer) error {
+			t, name, err := cs.compileSnippet(string(body))
+			if err != nil {
+				return err
+			}
+			return t.ExecuteTemplate(w, name, cs.newRenderData(t, name, data, w))
+		}
+	default:
+		return body
+	}
+	return &Body{render: func(w io.Writer) error {
+		if err := render(w); err != nil {
+			return fmt.Errorf("<%s> body: %w", comp, err)
+		}
+		return nil
+	}}
+}
+
+func (cs *compiledSet) slotBody(body any) (any, *template.Template, error) {
+	switch body := body.(type) {
+	case TemplateBody:
+		t, name, err := cs.compileSnippet(string(body))
+		return name, t, err
+	case SlotFunc:
+		return body, nil, nil
+	case func(io.Writer, any) error:
+		return SlotFunc(body), nil, nil
+	case func(io.Writer) error:
+		return SlotFunc(func(w io.Writer, data any) error {
+			return body(w)
+		}), nil, nil
+	case string, template.HTML:
+		return SlotFunc(func(w io.Writer, data any) error {
+			return writeResult(w, body)
+		}), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported slot body type %T", body)
+	}
+}
+
+func callFunc(fn any, rd *RenderData) (any, error) {
+	switch fn := fn.(type) {
+	case nil:
+		return nil, fmt.Errorf("func is not defined")
+	case func(*RenderData) (any, error):
+		return fn(rd)
+	}
+	out := reflect.ValueOf(fn).Call([]reflect.Value{reflect.ValueOf(rd)})
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	return out[0].Interface(), nil
+}
+
+func writeResult(w io.Writer, result any) error {
+	var s string
+	switch v := result.(type) {
+	case template.HTML:
+		s = string(v)
+	case string:
+		s = template.HTMLEscapeString(v)
+	default:
+		s = template.HTMLEscapeString(fmt.Sprint(v))
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// StructArgs converts a props struct into component args, using the same
+// field naming rules as typed component funcs.
+func StructArgs(props any) map[string]any {
+	v := reflect.ValueOf(props)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return map[string]any{}
+		}
+		v = v.Elem()
+	}
+	fields, err := propFields(v.Type())
+	if err != nil {
+		panic(err)
+	}
+	args := make(map[string]any, len(fields))
+	for _, f := range fields {
+		fv := v.FieldByIndex(f.index)
+		if fv.Kind() == reflect.Interface && fv.IsNil() {
+			continue
+		}
+		args[f.Name] = fv.Interface()
+	}
+	return args
+}
@@ -0,0 +1,344 @@
+package minicomponents
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+type RenderData struct {
+	Data  any
+	Args  map[string]any
+	ctx   *renderContext
+	frame *callFrame
+}
+
+// renderContext is shared by all RenderData of one template execution.
+type renderContext struct {
+	tmpl *template.Template
+	set  *compiledSet
+	// w is the writer that the template is executing into, which bodies
+	// and slots in print position stream into.
+	w io.Writer
+	// page is the template being executed, for ComponentStyles and
+	// ComponentScripts.
+	page   string
+	assets *assetState
+}
+
+// callFrame is an entry of the component call stack. Frames are immutable
+// and shared, so the stack of every RenderData is just its innermost frame.
+type callFrame struct {
+	comp   string
+	pos    string
+	body   string // generated template name for body frames
+	parent *callFrame
+	depth  int
+}
+
+func (f *callFrame) push(comp, pos string) *callFrame {
+	if f == nil {
+		return &callFrame{comp: comp, pos: pos, depth: 1}
+	}
+	return &callFrame{comp: comp, pos: pos, parent: f, depth: f.depth + 1}
+}
+
+// pushBody enters the body of a component, which does not count towards
+// the nesting depth.
+func (f *callFrame) pushBody(name string, info bodyInfo) *callFrame {
+	nf := &callFrame{comp: info.Comp, pos: info.Pos, body: name, parent: f}
+	if f != nil {
+		nf.depth = f.depth
+	}
+	return nf
+}
+
+const maxStackFramesShown = 16
+
+// String formats the stack outermost first, eliding the middle of deep
+// stacks.
+func (f *callFrame) String() string {
+	var names []string
+	for ; f != nil; f = f.parent {
+		if f.body == "" {
+			names = append(names, f.comp)
+		}
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	if n := len(names); n > maxStackFramesShown {
+		half := maxStackFramesShown / 2
+		elided := fmt.Sprintf("… %d more …", n-2*half)
+		names = append(append(names[:half:half], elided), names[n-half:]...)
+	}
+	return strings.Join(names, " > ")
+}
+
+func (d *RenderData) Bind(value any, args ...any) *RenderData {
+	n := len(args)
+	if n%2 != 0 {
+		panic(fmt.Errorf("odd number of arguments %d: %v", n, args))
+	}
+	m := make(map[string]any, n/2)
+	for i := 0; i < n; i += 2 {
+		key, value := args[i], args[i+1]
+		if keyStr, ok := key.(string); ok {
+			m[keyStr] = value
+		} else {
+			panic(fmt.Errorf("argument %d must be a string, got %T: %v", i, key, key))
+		}
+	}
+	return &RenderData{
+		Data:  value,
+		Args:  m,
+		ctx:   d.ctx,
+		frame: d.frame,
+	}
+}
+
+// Call is like Bind, but also enters the given component, which is how
+// rewritten templates invoke components when compiled by a Registry. pos is
+// the file:line of the component tag.
+func (d *RenderData) Call(comp, pos string, value any, args ...any) (*RenderData, error) {
+	rd := d.Bind(value, args...)
+	rd.frame = d.frame.push(comp, pos)
+	if d.ctx != nil && d.ctx.set.maxDepth > 0 && rd.frame.depth > d.ctx.set.maxDepth {
+		return nil, withStack(fmt.Errorf("component nesting exceeds %d levels: %v", d.ctx.set.maxDepth, rd.frame), rd.frame)
+	}
+	if d.ctx != nil && (d.ctx.set.styles[comp] != "" || len(d.ctx.set.scripts[comp]) > 0) {
+		d.ctx.assets.use(comp)
+	}
+	return rd, nil
+}
+
+// SlotFunc renders a slot body from Go code; data is the value that the
+// component passes to the slot.
+type SlotFunc func(w io.Writer, data any) error
+
+func evalTemplate(body any, data *RenderData) (template.HTML, error) {
+	var buf strings.Builder
+	if err := executeBody(&buf, body, data); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func executeBody(w io.Writer, body any, data *RenderData) error {
+	switch body := body.(type) {
+	case string:
+		if data.ctx == nil {
+			return fmt.Errorf("eval %q: data is not bound to a registry", body)
+		}
+		bd := *data
+		if info, ok := data.ctx.set.body(body); ok {
+			bd.frame = data.frame.pushBody(body, info)
+		}
+		ctx := *data.ctx
+		ctx.w = w
+		bd.ctx = &ctx
+		data = &bd
+		if err := data.ctx.tmpl.ExecuteTemplate(w, body, data); err != nil {
+			return withStack(err, data.frame)
+		}
+	case SlotFunc:
+		if err := body(w, data.Data); err != nil {
+			return withStack(err, data.frame)
+		}
+	default:
+		return fmt.Errorf("eval: cannot evaluate %T", body)
+	}
+	return nil
+}
+
+// Body is a component body that renders only when printed. Templates print
+// it like any other value, see printBodies. Go funcs that take a props
+// struct can declare a *Body field and call Render or HTML; funcs that read
+// RenderData.Args get a template.HTML instead.
+type Body struct {
+	render func(w io.Writer) error
+}
+
+func (b *Body) Render(w io.Writer) error {
+	return b.render(w)
+}
+
+func (b *Body) HTML() (template.HTML, error) {
+	var buf strings.Builder
+	if err := b.render(&buf); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// withRenderedBodies returns d with the *Body args rendered to
+// template.HTML.
+func (d *RenderData) withRenderedBodies() (*RenderData, error) {
+	var args map[string]any
+	for k, v := range d.Args {
+		b, ok := v.(*Body)
+		if !ok {
+			continue
+		}
+		if args == nil {
+			args = make(map[string]any, len(d.Args))
+			for k, v := range d.Args {
+				args[k] = v
+			}
+		}
+		h, err := b.HTML()
+		if err != nil {
+			return d, err
+		}
+		args[k] = h
+	}
+	if args == nil {
+		return d, nil
+	}
+	rd := *d
+	rd.Args = args
+	return &rd, nil
+}
+
+// dataScope lets a page or snippet range over its data, which sets . to the
+// data even when it is nil, false or zero, unlike {{with .Data}}.
+func dataScope(rd *RenderData) []any {
+	return []any{rd.Data}
+}
+
+// printBody is appended to print actions by printBodies. html/template
+// would print a *Body as an escaped pointer, so it renders bodies to
+// template.HTML and passes other values through.
+func printBody(v any) (any, error) {
+	if b, ok := v.(*Body); ok {
+		return b.HTML()
+	}
+	return v, nil
+}
+
+// writeEval is eval for slots in print position: it renders straight into
+// the output and returns nothing to print.
+func writeEval(body any, data *RenderData) (template.HTML, error) {
+	if data.ctx == nil || data.ctx.w == nil {
+		return evalTemplate(body, data)
+	}
+	return "", executeBody(data.ctx.w, body, data)
+}
+
+// writeBody is render for bodies in print position, streaming a *Body into
+// the output of rd's template.
+func writeBody(rd any, v any) (template.HTML, error) {
+	d, ok := rd.(*RenderData)
+	b, isBody := v.(*Body)
+	if !ok || !isBody || d.ctx == nil || d.ctx.w == nil {
+		return renderValue(v)
+	}
+	return "", b.Render(d.ctx.w)
+}
+
+// dynamic renders <c-dynamic is=...>, looking up the component by name.
+// dot is the data at the tag, which the body is bound to.
+func dynamic(rd *RenderData, name any, pos string, dot any, args ...any) (template.HTML, error) {
+	var buf strings.Builder
+	if err := renderDynamic(&buf, rd, name, pos, dot, args); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// writeDynamic is dynamic in print position, see writeEval.
+func writeDynamic(rd *RenderData, name any, pos string, dot any, args ...any) (template.HTML, error) {
+	if rd.ctx == nil || rd.ctx.w == nil {
+		return dynamic(rd, name, pos, dot, args...)
+	}
+	return "", renderDynamic(rd.ctx.w, rd, name, pos, dot, args)
+}
+
+func renderDynamic(w io.Writer, rd *RenderData, name any, pos string, dot any, args []any) error {
+	if rd.ctx == nil {
+		return fmt.Errorf("<%s>: data is not bound to a registry", dynamicComponent)
+	}
+	frame := rd.frame.push(dynamicComponent, pos)
+	compName, ok := name.(string)
+	if !ok {
+		return withStack(fmt.Errorf("is must be a component name, got %T", name), frame)
+	}
+	def := rd.ctx.set.defs[compName]
+	if def == nil {
+		return withStack(fmt.Errorf("unknown component <%s>", compName), frame)
+	}
+
+	// mirror the args that the rewriter passes to a static tag
+	bound := rd.Bind(nil, args...).Args
+	data, hasData := bound["data"]
+	delete(bound, "data")
+	if !hasData && def.HasSlots {
+		data = dot
+	}
+	var slotArgs []any
+	if body, ok := bound["bodyTemplate"]; ok {
+		if def.HasSlots {
+			slotArgs = append(slotArgs, "bodyTemplate", body)
+		} else {
+			delete(bound, "bodyTemplate")
+			bound["body"] = lazyEval(body, rd.Bind(dot))
+		}
+	}
+
+	ctx := *rd.ctx
+	ctx.w = w
+	parent := *rd
+	parent.ctx = &ctx
+	if err := ctx.set.callComponent(w, &parent, def, compName, pos, data, bound, slotArgs); err != nil {
+		return withStack(err, frame)
+	}
+	return nil
+}
+
+func lazyEval(body any, data *RenderData) *Body {
+	return &Body{render: func(w io.Writer) error {
+		return executeBody(w, body, data)
+	}}
+}
+
+// renderValue prints a value as HTML, rendering bodies; the rewriter routes
+// prints of .Args.body through it because html/template would escape a
+// *Body.
+func renderValue(v any) (template.HTML, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case *Body:
+		return v.HTML()
+	case template.HTML:
+		return v, nil
+	case string:
+		return template.HTML(template.HTMLEscapeString(v)), nil
+	default:
+		return template.HTML(template.HTMLEscapeString(fmt.Sprint(v))), nil
+	}
+}
+
+// concatHTML joins simple component bodies. Even args are literal markup
+// from the template source, odd args are values that get escaped unless
+// they are already template.HTML.
+func concatHTML(parts ...any) (template.HTML, error) {
+	var buf strings.Builder
+	for i, part := range parts {
+		if i%2 == 0 {
+			buf.WriteString(part.(string))
+			continue
+		}
+		s, err := renderValue(part)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(string(s))
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func errorFunc(message string) (string, error) {
+	return "", fmt.Errorf("%s", message)
+}
@@ -0,0 +1,599 @@
+package minicomponents
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sourceText answers position queries about a template being rewritten.
+// Queries are expected in increasing order of position, which makes them
+// linear in the size of the template overall. Nested bodies are rewritten
+// in views of the same sourceText, see upTo, so that they share the work.
+type sourceText struct {
+	// text is the template up to the end of the part being rewritten.
+	text string
+	*sourceState
+}
+
+type sourceState struct {
+	full      string
+	firstLine int
+
+	linePos int
+	line    int
+
+	ctxPos int
+	ctx    htmlContext
+
+	escapes, rawRegions markerFinder
+
+	closers map[int][2]int
+}
+
+func newSourceText(text string, firstLine int) *sourceText {
+	return &sourceText{text: text, sourceState: &sourceState{
+		full:       text,
+		firstLine:  firstLine,
+		line:       firstLine,
+		escapes:    markerFinder{marker: escapedTagPrefix},
+		rawRegions: markerFinder{marker: rawOffMarker},
+	}}
+}
+
+// upTo returns a view of s that ends at end.
+func (s *sourceText) upTo(end int) *sourceText {
+	return &sourceText{text: s.text[:end], sourceState: s.sourceState}
+}
+
+func (s *sourceText) lineAt(pos int) int {
+	if pos < s.linePos {
+		s.line -= strings.Count(s.full[pos:s.linePos], "\n")
+	} else {
+		s.line += strings.Count(s.full[s.linePos:pos], "\n")
+	}
+	s.linePos = pos
+	return s.line
+}
+
+// closingTag finds the </name> that closes a tag whose contents start at
+// pos, like findClosingTag, but matches all tags of the template in one pass
+// on the first call.
+func (s *sourceText) closingTag(pos int, name string) (start, end int) {
+	if s.closers == nil {
+		s.closers = closingTags(s.full)
+	}
+	if m, ok := s.closers[pos]; ok && m[1] <= len(s.text) {
+		return m[0], m[1]
+	}
+	// the opening tag ends elsewhere than the scan above thought, e.g. at
+	// a > in a quoted attr
+	if start, end := findClosingTag(s.text[pos:], name); start >= 0 {
+		return pos + start, pos + end
+	}
+	return -1, -1
+}
+
+// isTextAt reports whether pos is in HTML text context, see htmlContext.
+func (s *sourceText) isTextAt(pos int) bool {
+	if pos < s.ctxPos {
+		s.ctxPos, s.ctx = 0, htmlContext{}
+	}
+	s.ctx.feed(s.full[s.ctxPos:pos])
+	s.ctxPos = pos
+	return s.ctx.isText()
+}
+
+// errf reports an error at the start of rest, which is a suffix of the text.
+func (s *sourceText) errf(rest string, format string, args ...any) *ParseErr {
+	pos := len(s.text) - len(rest)
+	return &ParseErr{
+		Code: s.full,
+		Pos:  pos,
+		Line: s.lineAt(pos),
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+var rawTextElements = []string{"script", "style", "textarea", "title"}
+
+// htmlContext roughly tracks the HTML context of markup, erring on the side
+// of not being in text: inside a tag, a comment or a raw text element.
+type htmlContext struct {
+	inTag   bool
+	comment bool
+	raw     string
+}
+
+func (c *htmlContext) isText() bool {
+	return !c.inTag && !c.comment && c.raw == ""
+}
+
+func (c *htmlContext) feed(s string) {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case c.comment:
+			if strings.HasPrefix(s[i:], "-->") {
+				c.comment = false
+				i += 2
+			}
+		case c.raw != "":
+			if s[i] == '<' && hasPrefixFold(s[i+1:], "/"+c.raw) {
+				c.raw = ""
+				c.inTag = true
+			}
+		case s[i] == '<':
+			if strings.HasPrefix(s[i:], "<!--") {
+				c.comment = true
+				i += 3
+				continue
+			}
+			c.inTag = true
+			for _, el := range rawTextElements {
+				if hasPrefixFold(s[i+1:], el) {
+					c.raw, c.inTag = el, false
+					break
+				}
+			}
+		case s[i] == '>':
+			c.inTag = false
+		}
+	}
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// The scanners below match the syntax of component tags without regexps;
+// each returns -1 when there is no match.
+
+// findComponentTag finds the next <c-name, returning the index of < and
+// the end of the name.
+func findComponentTag(s string) (start, nameEnd int) {
+	for off := 0; ; {
+		i := strings.IndexByte(s[off:], '<')
+		if i < 0 {
+			return -1, -1
+		}
+		i += off
+		if n := componentNameLen(s[i+1:]); n > 0 {
+			return i, i + 1 + n
+		}
+		off = i + 1
+	}
+}
+
+// componentNameLen matches a c-name at the start of s.
+func componentNameLen(s string) int {
+	if len(s) < 3 || (s[0] != 'c' && s[0] != 'C') || s[1] != '-' {
+		return 0
+	}
+	nameStart := 2
+	if strings.HasPrefix(s[nameStart:], privatePrefix) {
+		nameStart += len(privatePrefix)
+	}
+	if n := nameLen(s[nameStart:]); n > 0 {
+		return nameStart + n
+	}
+	return 0
+}
+
+const (
+	escapedTagPrefix = `<\c-`
+	rawOffMarker     = "{{/* minicomponents:off */}}"
+	rawOnMarker      = "{{/* minicomponents:on */}}"
+)
+
+// markerFinder finds the next occurrence of a marker at or after increasing
+// positions, searching each part of the text once.
+type markerFinder struct {
+	marker  string
+	next    int
+	scanned bool
+}
+
+func (f *markerFinder) find(s string, from int) int {
+	if f.scanned && (f.next < 0 || f.next >= from) {
+		return f.next
+	}
+	f.scanned = true
+	if i := strings.Index(s[from:], f.marker); i >= 0 {
+		f.next = from + i
+	} else {
+		f.next = -1
+	}
+	return f.next
+}
+
+// firstFound returns the smaller of two indexes, ignoring -1.
+func firstFound(a, b int) int {
+	if a < 0 || (b >= 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// withoutRaw blanks out raw regions and escaped tags, keeping positions and
+// line numbers intact, for scans that look for component tags.
+func withoutRaw(s string) string {
+	if !strings.Contains(s, escapedTagPrefix) && !strings.Contains(s, rawOffMarker) && !strings.Contains(strings.ToLower(s), "<c-raw>") {
+		return s
+	}
+	b := []byte(s)
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case strings.HasPrefix(rest, escapedTagPrefix):
+			blankOut(b, i, i+2)
+			i += 2
+		case strings.HasPrefix(rest, rawOffMarker):
+			end := strings.Index(rest, rawOnMarker)
+			if end < 0 {
+				end = len(rest)
+			}
+			blankOut(b, i, i+end)
+			i += end + 1
+		case hasPrefixFold(rest, "<c-raw>"):
+			end := strings.Index(strings.ToLower(rest), "</c-raw>")
+			if end < 0 {
+				end = len(rest)
+			}
+			blankOut(b, i, i+end)
+			i += end + 1
+		default:
+			i++
+		}
+	}
+	return string(b)
+}
+
+// privatePrefix starts the names of templates private to a file, see
+// expandShorthands and checkPrivateDefines.
+const privatePrefix = "@@__"
+
+// expandShorthands expands $@ to $.Args. and @@__ to the file's private
+// prefix inside {{...}} actions. Text outside of actions, including
+// attribute values, is left alone.
+// <c-@@__name> tags are resolved by the rewriter. The names of the private
+// templates are returned too.
+func expandShorthands(s string, baseName string) (string, []string) {
+	if !strings.Contains(s, "$@") && !strings.Contains(s, privatePrefix) {
+		return s, nil
+	}
+	var private []string
+	var out strings.Builder
+	out.Grow(len(s))
+	// actions are looked for outside of raw regions, which stay as is
+	masked := withoutRaw(s)
+	actions := markerFinder{marker: "{{"}
+	for pos := 0; ; {
+		i, n := actions.find(masked, pos), -1
+		if i >= 0 {
+			n = actionLen(masked[i:])
+		}
+		if n < 0 {
+			out.WriteString(s[pos:])
+			return out.String(), private
+		}
+		out.WriteString(s[pos:i])
+		action := s[i : i+n]
+		if !isCommentAction(action) {
+			action = expandArgs(action)
+			action, private = expandPrivate(action, baseName, private)
+		}
+		out.WriteString(action)
+		pos = i + n
+	}
+}
+
+// expandArgs expands $@ in an action, leaving quoted strings alone.
+func expandArgs(action string) string {
+	if !strings.Contains(action, "$@") {
+		return action
+	}
+	var out strings.Builder
+	last := 0
+	for i := 0; i < len(action); i++ {
+		switch action[i] {
+		case '"', '\'', '`':
+			q := action[i]
+			for i++; i < len(action) && action[i] != q; i++ {
+				if action[i] == '\\' && q != '`' {
+					i++
+				}
+			}
+		case '$':
+			if strings.HasPrefix(action[i:], "$@") {
+				out.WriteString(action[last:i])
+				out.WriteString("$.Args.")
+				last = i + 2
+				i++
+			}
+		}
+	}
+	out.WriteString(action[last:])
+	return out.String()
+}
+
+// expandPrivate expands @@__ in an action, quoted strings included, since it
+// mostly occurs in template names like {{template "@@__row"}}. The expanded
+// names are appended to private.
+func expandPrivate(action, baseName string, private []string) (string, []string) {
+	if !strings.Contains(action, privatePrefix) {
+		return action, private
+	}
+	var out strings.Builder
+	for {
+		i := strings.Index(action, privatePrefix)
+		if i < 0 {
+			break
+		}
+		out.WriteString(action[:i])
+		action = action[i+len(privatePrefix):]
+		n := strings.IndexAny(action, "\"'` \t\r\n()|}")
+		if n < 0 {
+			n = len(action)
+		}
+		name := baseName + "__" + action[:n]
+		private = append(private, name)
+		out.WriteString(name)
+		action = action[n:]
+	}
+	out.WriteString(action)
+	return out.String(), private
+}
+
+// actionLen returns the length of the {{...}} action at the start of s,
+// skipping over quoted strings, or -1 if it is not terminated.
+func actionLen(s string) int {
+	if isCommentAction(s) {
+		if i := strings.Index(s, "*/"); i >= 0 {
+			if j := strings.Index(s[i:], "}}"); j >= 0 {
+				return i + j + 2
+			}
+		}
+		return -1
+	}
+	for i := 2; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'', '`':
+			q := s[i]
+			for i++; i < len(s) && s[i] != q; i++ {
+				if s[i] == '\\' && q != '`' {
+					i++
+				}
+			}
+		case '}':
+			if strings.HasPrefix(s[i:], "}}") {
+				return i + 2
+			}
+		}
+	}
+	return -1
+}
+
+func isCommentAction(s string) bool {
+	s = strings.TrimPrefix(s[2:], "- ")
+	return strings.HasPrefix(s, "/*")
+}
+
+// withoutDefines blanks out <c-define> elements like withoutRaw, so that
+// scanning a file does not see the slots of the components defined in it.
+func withoutDefines(s string) string {
+	lower := strings.ToLower(s)
+	if !strings.Contains(lower, "<c-define") {
+		return s
+	}
+	b := []byte(s)
+	for i := 0; ; {
+		start := strings.Index(lower[i:], "<c-define")
+		if start < 0 {
+			break
+		}
+		start += i
+		i = start + len("<c-define")
+		if i < len(s) && isNameChar(s[i]) {
+			continue
+		}
+		end := len(s)
+		if _, tagEnd := findTagEnd(lower[i:]); tagEnd >= 0 {
+			if _, closeEnd := findClosingTag(lower[i+tagEnd:], "c-define"); closeEnd >= 0 {
+				end = i + tagEnd + closeEnd
+			}
+		}
+		blankOut(b, start, end)
+		i = end
+	}
+	return string(b)
+}
+
+// blankOut replaces b[from:to] with spaces, except for newlines.
+func blankOut(b []byte, from, to int) {
+	for i := from; i < to; i++ {
+		if b[i] != '\n' {
+			b[i] = ' '
+		}
+	}
+}
+
+func countComponentTags(s string) int {
+	n := 0
+	for {
+		_, end := findComponentTag(s)
+		if end < 0 {
+			return n
+		}
+		n++
+		s = s[end:]
+	}
+}
+
+func isNameChar(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '-'
+}
+
+func nameLen(s string) int {
+	n := 0
+	for n < len(s) && isNameChar(s[n]) {
+		n++
+	}
+	return n
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+// scanTagEnd matches /> or > at the start of s, returning its length.
+func scanTagEnd(s string) int {
+	if strings.HasPrefix(s, "/>") {
+		return 2
+	}
+	if strings.HasPrefix(s, ">") {
+		return 1
+	}
+	return -1
+}
+
+// findClosingTag finds the </name> that closes a tag whose contents start
+// s, skipping over nested tags of the same name. It returns the start and
+// the end of the closing tag.
+func findClosingTag(s string, name string) (start, end int) {
+	opening, closing := "<"+name, "</"+name+">"
+	depth := 0
+	for off := 0; ; {
+		i := strings.IndexByte(s[off:], '<')
+		if i < 0 {
+			return -1, -1
+		}
+		i += off
+		rest := s[i:]
+		switch {
+		case strings.HasPrefix(rest, closing):
+			if depth == 0 {
+				return i, i + len(closing)
+			}
+			depth--
+			off = i + len(closing)
+			continue
+		case strings.HasPrefix(rest, opening) && len(rest) > len(opening) && !isNameChar(rest[len(opening)]):
+			if tagStart, tagEnd := findTagEnd(rest); tagEnd >= 0 && rest[tagStart:tagEnd] == ">" {
+				depth++
+			}
+		}
+		off = i + 1
+	}
+}
+
+// closingTags matches the component tags of s that have contents with
+// their closing tags, mapping the end of each opening tag to the start and
+// the end of its closing tag. Like findClosingTag, it pays no attention to
+// raw regions.
+func closingTags(s string) map[int][2]int {
+	closers := make(map[int][2]int)
+	open := make(map[string][]int)
+	for off := 0; ; {
+		i := strings.IndexByte(s[off:], '<')
+		if i < 0 {
+			return closers
+		}
+		i += off
+		off = i + 1
+		if i+1 < len(s) && s[i+1] == '/' {
+			n := componentNameLen(s[i+2:])
+			name := s[i+2 : i+2+n]
+			if stack := open[name]; n > 0 && len(stack) > 0 && strings.HasPrefix(s[i+2+n:], ">") {
+				closers[stack[len(stack)-1]] = [2]int{i, i + 3 + n}
+				open[name] = stack[:len(stack)-1]
+			}
+		} else if n := componentNameLen(s[i+1:]); n > 0 {
+			if tagStart, tagEnd := findTagEnd(s[i:]); tagEnd >= 0 && s[i+tagStart:i+tagEnd] == ">" {
+				name := s[i+1 : i+1+n]
+				open[name] = append(open[name], i+tagEnd)
+			}
+		}
+	}
+}
+
+// findTagEnd finds the first /> or >, returning its start and end.
+func findTagEnd(s string) (start, end int) {
+	i := strings.IndexByte(s, '>')
+	if i < 0 {
+		return -1, -1
+	}
+	if i > 0 && s[i-1] == '/' {
+		return i - 1, i + 1
+	}
+	return i, i + 1
+}
+
+// scanAttrName matches an attribute name followed by =, a space, / or >,
+// returning the length of the name.
+func scanAttrName(s string) int {
+	n := nameLen(s)
+	if n == 0 || n == len(s) {
+		return -1
+	}
+	if b := s[n]; b == '=' || b == '/' || b == '>' || isSpace(b) {
+		return n
+	}
+	return -1
+}
+
+// scanQuoted matches a value in the given quotes, returning its contents
+// and the length of the match.
+func scanQuoted(s string, quote byte) (string, int) {
+	if len(s) == 0 || s[0] != quote {
+		return "", -1
+	}
+	i := strings.IndexByte(s[1:], quote)
+	if i < 0 {
+		return "", -1
+	}
+	return s[1 : 1+i], i + 2
+}
+
+// scanGoValue matches a single-line {{...}} action.
+func scanGoValue(s string) (string, int) {
+	if len(s) < 5 || !strings.HasPrefix(s, "{{") {
+		return "", -1
+	}
+	i := strings.Index(s[3:], "}}")
+	if i < 0 {
+		return "", -1
+	}
+	expr := s[2 : 3+i]
+	if strings.IndexByte(expr, '\n') >= 0 {
+		return "", -1
+	}
+	return expr, i + 5
+}
+
+// scanNakedValue matches an unquoted value.
+func scanNakedValue(s string) int {
+	n := 0
+	for n < len(s) {
+		b := s[n]
+		if isSpace(b) || b == '/' || b == '<' || b == '>' || b == '"' || b == '\'' {
+			break
+		}
+		n++
+	}
+	if n == 0 {
+		return -1
+	}
+	return n
+}
+
+// findAttrEnd finds the first space, /> or >.
+func findAttrEnd(s string) int {
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case isSpace(b), b == '>':
+			return i
+		case b == '/' && i+1 < len(s) && s[i+1] == '>':
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,150 @@
+package minicomponents
+
+import (
+	"html/template"
+	"io"
+	"strings"
+)
+
+// WriteScripts compiles the registry and writes the inline classic scripts
+// of all components, for serving as a single static file instead of
+// {{$.ComponentScripts}}. Scripts with a src or of type module are left out.
+func (r *Registry) WriteScripts(w io.Writer) error {
+	return r.inlineScripts(false, func(name, js string) error {
+		_, err := io.WriteString(w, "/* "+name+" */\n"+js+"\n")
+		return err
+	})
+}
+
+// ScriptModules compiles the registry and returns the inline module scripts
+// of each component by component name, for serving as one module file per
+// component so that their top-level declarations and imports don't clash.
+func (r *Registry) ScriptModules() (map[string]string, error) {
+	modules := make(map[string]string)
+	err := r.inlineScripts(true, func(name, js string) error {
+		modules[name] += js + "\n"
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return modules, nil
+}
+
+// inlineScripts calls emit with the inline scripts of all components that
+// are or aren't modules, skipping repeated ones.
+func (r *Registry) inlineScripts(module bool, emit func(name, js string) error) error {
+	r.mu.Lock()
+	err := r.compile()
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	cs, err := r.current()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, name := range sortedKeys(cs.scripts) {
+		for _, script := range cs.scripts[name] {
+			_, elements := cutElements(script, "script", func(element) bool { return true })
+			for _, el := range elements {
+				js := strings.TrimSpace(el.content)
+				if el.hasAttr("src") || (scriptType(el) == "module") != module || js == "" || seen[js] {
+					continue
+				}
+				seen[js] = true
+				if err := emit(name, js); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ComponentScripts prints the <script> elements of the components that the
+// page uses and of the given extra components, skipping the ones printed
+// earlier in the same render. Identical scripts of different components are
+// printed once. Like ComponentStyles, it is a method so that it sees the
+// components used by the current render, and a second call at the end of
+// <body> adds the components that were only known at runtime.
+func (d *RenderData) ComponentScripts(extra ...string) (template.HTML, error) {
+	if d.ctx == nil || len(d.ctx.set.scripts) == 0 {
+		return "", nil
+	}
+	cs, st := d.ctx.set, d.ctx.assets
+	names := st.unprinted(cs, d.ctx.page, extra, st.printedScripts, func(comp string) bool {
+		return len(cs.scripts[comp]) > 0
+	})
+	var buf strings.Builder
+	for _, comp := range names {
+		for _, script := range cs.scripts[comp] {
+			if st.scriptTexts[script] {
+				continue
+			}
+			st.scriptTexts[script] = true
+			if buf.Len() > 0 {
+				buf.WriteString("\n")
+			}
+			buf.WriteString(script)
+		}
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// cutScripts removes the <script> elements of a component template that can
+// be hoisted and returns them. Scripts that contain template actions, and
+// those of types other than JavaScript, like JSON data blocks, stay in
+// place.
+func cutScripts(code string) (string, []string) {
+	code, elements := cutElements(code, "script", func(el element) bool {
+		return isJavaScript(el) && !strings.Contains(el.attrs, "{{") && !strings.Contains(el.content, "{{")
+	})
+	var scripts []string
+	for _, el := range elements {
+		if el.hasAttr("src") || strings.TrimSpace(el.content) != "" {
+			scripts = append(scripts, el.String("script"))
+		}
+	}
+	return code, scripts
+}
+
+func isJavaScript(el element) bool {
+	switch scriptType(el) {
+	case "", "module", "text/javascript", "application/javascript":
+		return true
+	}
+	return false
+}
+
+// scriptType returns the lowercase type attribute of a script element.
+func scriptType(el element) string {
+	attrs := strings.ToLower(el.attrs)
+	for off := 0; ; {
+		i := strings.Index(attrs[off:], "type")
+		if i < 0 {
+			return ""
+		}
+		i += off
+		off = i + len("type")
+		if i > 0 && !isSpace(attrs[i-1]) {
+			continue
+		}
+		rest := strings.TrimLeft(attrs[off:], " \t\r\n")
+		if !strings.HasPrefix(rest, "=") {
+			continue
+		}
+		rest = strings.TrimLeft(rest[1:], " \t\r\n")
+		if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+			if end := strings.IndexByte(rest[1:], rest[0]); end >= 0 {
+				return strings.TrimSpace(rest[1 : end+1])
+			}
+			return ""
+		}
+		if end := strings.IndexAny(rest, " \t\r\n>/"); end >= 0 {
+			rest = rest[:end]
+		}
+		return rest
+	}
+}
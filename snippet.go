@@ -0,0 +1,166 @@
+package minicomponents
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+type SnippetLimits struct {
+	// MaxSize is the maximum length of snippet source in bytes.
+	MaxSize int
+	// MaxComponents is the maximum number of component tags in a snippet,
+	// including nested ones.
+	MaxComponents int
+	// MaxActions is the maximum number of {{...}} actions in a snippet.
+	MaxActions int
+	// MaxCached is the number of compiled snippets to keep; the least
+	// recently used ones are evicted first.
+	MaxCached int
+}
+
+var DefaultSnippetLimits = SnippetLimits{
+	MaxSize:       64 * 1024,
+	MaxComponents: 200,
+	MaxActions:    1000,
+	MaxCached:     1000,
+}
+
+// SetSnippetLimits configures the checks applied to RenderString and
+// TemplateBody sources, starting with the next Compile. Zero fields are not
+// limited.
+func (r *Registry) SetSnippetLimits(limits SnippetLimits) *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.snippetLimits = limits
+	return r
+}
+
+// RenderString renders component markup that is only known at runtime,
+// e.g. authored in a CMS. Compiled snippets are cached by content.
+func (r *Registry) RenderString(w io.Writer, code string, data any) error {
+	cs, err := r.current()
+	if err != nil {
+		return err
+	}
+	t, name, err := cs.compileSnippet(code)
+	if err != nil {
+		return err
+	}
+	return componentError(t.ExecuteTemplate(w, name, cs.newRenderData(t, name, data, w)))
+}
+
+func checkSnippet(code string, limits SnippetLimits) error {
+	if limits.MaxSize > 0 && len(code) > limits.MaxSize {
+		return fmt.Errorf("snippet is too large: %d bytes, max %d", len(code), limits.MaxSize)
+	}
+	if n := countComponentTags(withoutRaw(code)); limits.MaxComponents > 0 && n > limits.MaxComponents {
+		return fmt.Errorf("snippet is too complex: %d components, max %d", n, limits.MaxComponents)
+	}
+	if n := strings.Count(code, "{{"); limits.MaxActions > 0 && n > limits.MaxActions {
+		return fmt.Errorf("snippet is too complex: %d actions, max %d", n, limits.MaxActions)
+	}
+	return nil
+}
+
+// compileSnippet rewrites code and parses it into a clone of the component
+// set, returning the clone and the name of the snippet template in it.
+func (cs *compiledSet) compileSnippet(code string) (*template.Template, string, error) {
+	name := "snippet___" + hashString(code)
+
+	if t := cs.lookupSnippet(name); t != nil {
+		return t, name, nil
+	}
+
+	// compile without holding snippetsMu, which renders take to look up
+	// bodies; two renders of a new snippet may both compile it
+	if err := checkSnippet(code, cs.limits); err != nil {
+		return nil, "", err
+	}
+	res, err := rewriteTemplate(code, name, cs.defs, rewriteOptions{trackCalls: true, file: "snippet"})
+	if err != nil {
+		return nil, "", err
+	}
+	t, err := cs.base.Clone()
+	if err != nil {
+		return nil, "", err
+	}
+	ownerOf := func(k string) string {
+		if _, ok := res.bodies[k]; ok || contains(res.private, k) {
+			return name
+		}
+		return cs.private[k]
+	}
+	if err := checkPrivateDefines(name, res.code, ownerOf); err != nil {
+		return nil, "", err
+	}
+	_, err = t.New(name).Parse(WrapTemplate(res.code, "{{range data_scope $}}", "{{end}}"))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkPrivateCalls(t, func(file string) bool { return file == name }, ownerOf); err != nil {
+		return nil, "", err
+	}
+	printBodies(t, func(tmpl *template.Template) bool {
+		return tmpl.Tree.ParseName == name && contains(res.defines, tmpl.Name())
+	})
+
+	cs.snippetsMu.Lock()
+	defer cs.snippetsMu.Unlock()
+	if el := cs.snippets[name]; el != nil {
+		// another render got there first
+		cs.snippetLRU.MoveToFront(el)
+		return el.Value.(*cachedSnippet).tmpl, name, nil
+	}
+	cs.addSnippet(&cachedSnippet{name: name, tmpl: t, bodies: res.bodies})
+	return t, name, nil
+}
+
+// lookupSnippet returns the compiled snippet of the given name, if cached,
+// marking it as recently used.
+func (cs *compiledSet) lookupSnippet(name string) *template.Template {
+	cs.snippetsMu.Lock()
+	defer cs.snippetsMu.Unlock()
+	if el := cs.snippets[name]; el != nil {
+		cs.snippetLRU.MoveToFront(el)
+		return el.Value.(*cachedSnippet).tmpl
+	}
+	return nil
+}
+
+// cachedSnippet is a compiled snippet in the LRU list of a compiledSet.
+type cachedSnippet struct {
+	name   string
+	tmpl   *template.Template
+	bodies map[string]bodyInfo
+}
+
+// addSnippet caches a compiled snippet, evicting the least recently used
+// ones beyond MaxCached. The caller holds snippetsMu.
+func (cs *compiledSet) addSnippet(sn *cachedSnippet) {
+	if cs.snippets == nil {
+		cs.snippets = make(map[string]*list.Element)
+		cs.snippetLRU = list.New()
+		cs.snippetBodies = make(map[string]bodyInfo)
+	}
+	cs.snippets[sn.name] = cs.snippetLRU.PushFront(sn)
+	for k, v := range sn.bodies {
+		cs.snippetBodies[k] = v
+	}
+	for cs.limits.MaxCached > 0 && cs.snippetLRU.Len() > cs.limits.MaxCached {
+		old := cs.snippetLRU.Remove(cs.snippetLRU.Back()).(*cachedSnippet)
+		delete(cs.snippets, old.name)
+		for k := range old.bodies {
+			delete(cs.snippetBodies, k)
+		}
+	}
+}
+
+func hashString(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:10])
+}
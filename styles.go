@@ -0,0 +1,214 @@
+package minicomponents
+
+import (
+	"html/template"
+	"io"
+	"strings"
+)
+
+// WriteStyles compiles the registry and writes the CSS of all components,
+// for serving as a single static stylesheet instead of {{$.ComponentStyles}}.
+func (r *Registry) WriteStyles(w io.Writer) error {
+	r.mu.Lock()
+	err := r.compile()
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	cs, err := r.current()
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(cs.styles) {
+		if _, err := io.WriteString(w, "/* "+name+" */\n"+cs.styles[name]+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ComponentStyles prints a <style> element with the CSS of the components
+// that the page uses and of the given extra components, skipping the ones
+// printed earlier in the same render. In <head>, {{$.ComponentStyles}}
+// covers the components that the page includes statically; a second call
+// at the end of <body> adds the ones that were only known at runtime, e.g.
+// via <c-dynamic>. Components behind {{if}}, {{range}} or {{with}} count as
+// included even if they end up not rendering, so that their CSS is already
+// there when they do. It is a method rather than a template func because it
+// needs the components used by the current render, which only d knows.
+func (d *RenderData) ComponentStyles(extra ...string) (template.HTML, error) {
+	if d.ctx == nil || len(d.ctx.set.styles) == 0 {
+		return "", nil
+	}
+	cs, st := d.ctx.set, d.ctx.assets
+	names := st.unprinted(cs, d.ctx.page, extra, st.printedStyles, func(comp string) bool {
+		return cs.styles[comp] != ""
+	})
+	if len(names) == 0 {
+		return "", nil
+	}
+	var buf strings.Builder
+	buf.WriteString("<style>\n")
+	for _, comp := range names {
+		buf.WriteString(cs.styles[comp])
+		buf.WriteString("\n")
+	}
+	buf.WriteString("</style>")
+	return template.HTML(buf.String()), nil
+}
+
+// cutStyles removes the <style> elements of a component template and
+// returns their CSS. The selectors of <style scoped> are limited to the
+// elements of the component's own markup by an attribute derived from its
+// name.
+func cutStyles(name, code string) (string, string) {
+	code, elements := cutElements(code, "style", func(element) bool { return true })
+	var css []string
+	scoped := false
+	attr := "data-c-" + hashString(name)[:8]
+	for _, el := range elements {
+		style := strings.TrimSpace(el.content)
+		if el.hasAttr("scoped") {
+			style = scopeCSS(style, attr)
+			scoped = true
+		}
+		if style != "" {
+			css = append(css, style)
+		}
+	}
+	if scoped {
+		code = addScopeAttr(code, attr)
+	}
+	return code, strings.Join(css, "\n")
+}
+
+// addScopeAttr adds attr to the start tags of all HTML elements in text
+// context, leaving component tags alone.
+func addScopeAttr(code, attr string) string {
+	// raw regions are blank in view, so their tags are left as written
+	view := withoutRaw(code)
+	src := newSourceText(view, 1)
+	var out strings.Builder
+	last := 0
+	for i := 0; i < len(view); i++ {
+		if view[i] != '<' || i+1 >= len(view) || !isLetter(view[i+1]) || hasPrefixFold(view[i+1:], "c-") || !src.isTextAt(i) {
+			continue
+		}
+		end := i + 1 + nameLen(code[i+1:])
+		out.WriteString(code[last:end])
+		out.WriteString(" " + attr)
+		last = end
+	}
+	out.WriteString(code[last:])
+	return out.String()
+}
+
+func isLetter(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// scopeCSS adds [attr] to the last compound selector of every rule,
+// descending into grouping at-rules like @media.
+func scopeCSS(css, attr string) string {
+	var out strings.Builder
+	for {
+		i := strings.IndexAny(css, "{;")
+		if i < 0 {
+			out.WriteString(css)
+			return out.String()
+		}
+		prelude := css[:i]
+		if css[i] == ';' {
+			out.WriteString(css[:i+1])
+			css = css[i+1:]
+			continue
+		}
+		end := matchingBrace(css, i)
+		if end < 0 {
+			out.WriteString(css)
+			return out.String()
+		}
+		block := css[i+1 : end]
+		trimmed := strings.TrimSpace(prelude)
+		switch {
+		case hasPrefixFold(trimmed, "@media"), hasPrefixFold(trimmed, "@supports"), hasPrefixFold(trimmed, "@container"), hasPrefixFold(trimmed, "@layer"):
+			out.WriteString(prelude + "{" + scopeCSS(block, attr) + "}")
+		case strings.HasPrefix(trimmed, "@"):
+			out.WriteString(css[:end+1])
+		default:
+			lead := prelude[:len(prelude)-len(strings.TrimLeft(prelude, " \t\r\n"))]
+			selectors := splitTopLevel(trimmed, ',')
+			for j, sel := range selectors {
+				selectors[j] = scopeSelector(strings.TrimSpace(sel), attr)
+			}
+			out.WriteString(lead + strings.Join(selectors, ", ") + " {" + block + "}")
+		}
+		if end+1 >= len(css) {
+			return out.String()
+		}
+		css = css[end+1:]
+	}
+}
+
+// matchingBrace returns the index of the } that closes the { at open, or
+// -1 if it is unterminated.
+func matchingBrace(css string, open int) int {
+	depth := 0
+	for i := open; i < len(css); i++ {
+		switch css[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitTopLevel splits s at sep outside of brackets and parentheses.
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		case sep:
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// scopeSelector adds [attr] to the last compound selector of sel, before
+// its pseudo-classes and pseudo-elements.
+func scopeSelector(sel, attr string) string {
+	compound, depth := 0, 0
+	pseudo := -1
+	for i := 0; i < len(sel); i++ {
+		switch b := sel[i]; {
+		case b == '(' || b == '[':
+			depth++
+		case b == ')' || b == ']':
+			depth--
+		case depth > 0:
+		case b == ' ' || b == '>' || b == '+' || b == '~':
+			compound, pseudo = i+1, -1
+		case b == ':' && pseudo < 0:
+			pseudo = i
+		}
+	}
+	at := len(sel)
+	if pseudo >= compound {
+		at = pseudo
+	}
+	return sel[:at] + "[" + attr + "]" + sel[at:]
+}
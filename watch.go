@@ -0,0 +1,153 @@
+package minicomponents
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var templateExts = map[string]bool{
+	".html":   true,
+	".gohtml": true,
+	".tmpl":   true,
+}
+
+type sourceDir struct {
+	dir   string
+	files map[string]fileStamp
+}
+
+type fileStamp struct {
+	path    string
+	rel     string
+	modTime time.Time
+	size    int64
+}
+
+// templateName maps a file path relative to a source dir to a template
+// name. Components are global and named after the file alone, pages keep
+// their directory: c-card.html is c-card, pages/home.html is pages/home.
+func templateName(rel string) string {
+	rel = filepath.ToSlash(rel)
+	name := strings.TrimSuffix(rel, path.Ext(rel))
+	if base := path.Base(name); isComponentName(base) {
+		return base
+	}
+	return name
+}
+
+func scanDir(dir string) (map[string]fileStamp, error) {
+	files := make(map[string]fileStamp)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !templateExts[filepath.Ext(p)] {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := templateName(rel)
+		if prev, dup := files[name]; dup {
+			return fmt.Errorf("%s and %s both define template %s", prev.path, p, name)
+		}
+		files[name] = fileStamp{path: p, rel: filepath.ToSlash(rel), modTime: fi.ModTime(), size: fi.Size()}
+		return nil
+	})
+	return files, err
+}
+
+// AddDir adds all template files under dir. Directories added this way are
+// rescanned by Reload and Watch.
+func (r *Registry) AddDir(dir string) error {
+	files, err := scanDir(dir)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, st := range files {
+		code, err := os.ReadFile(st.path)
+		if err != nil {
+			return err
+		}
+		r.sources[name] = string(code)
+		r.files[name] = st.rel
+	}
+	r.dirs = append(r.dirs, &sourceDir{dir: dir, files: files})
+	return nil
+}
+
+// Reload picks up changed, added and removed files in the directories added
+// via AddDir and recompiles if anything changed. If compilation fails, the
+// last good set stays in use, and the error is returned and reported via
+// LastError and OnError.
+func (r *Registry) Reload() (changed bool, err error) {
+	r.mu.Lock()
+	changed, err = r.reload()
+	r.mu.Unlock()
+	if changed || err != nil {
+		err = r.reportErr(err)
+	}
+	return changed, err
+}
+
+func (r *Registry) reload() (bool, error) {
+	changed := false
+	for _, sd := range r.dirs {
+		files, err := scanDir(sd.dir)
+		if err != nil {
+			return changed, err
+		}
+		for name, st := range files {
+			if prev, ok := sd.files[name]; ok && prev == st {
+				continue
+			}
+			code, err := os.ReadFile(st.path)
+			if err != nil {
+				return changed, err
+			}
+			r.sources[name] = string(code)
+			r.files[name] = st.rel
+			changed = true
+		}
+		for name := range sd.files {
+			if _, ok := files[name]; !ok {
+				delete(r.sources, name)
+				delete(r.files, name)
+				changed = true
+			}
+		}
+		sd.files = files
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, r.compile()
+}
+
+// Watch polls the directories added via AddDir every interval and reloads
+// the registry when files change, until ctx is done. Meant for development.
+func (r *Registry) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Reload()
+		}
+	}
+}